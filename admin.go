@@ -0,0 +1,125 @@
+package session_redis
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 会话占用的内存字节数，会话不存在时返回0
+// 用于运维和管理界面找出异常膨胀的会话
+func (this *redisConnect) MemoryUsage(id string) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	size, err := redis.Int64(conn.Do("MEMORY", "USAGE", this.key(id)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+	if err != nil {
+		this.failed("memory", id, err)
+		return 0, err
+	}
+	return size, nil
+}
+
+// 预览 Clear 会删除的会话，返回数量和最多 sample 个会话ID，不做任何删除
+// 用于在生产环境清理前先核对前缀
+func (this *redisConnect) Preview(prefix string, sample int) (int64, []string, error) {
+	if this.client == nil {
+		return 0, nil, errInvalidCacheConnection
+	}
+
+	conn := this.get()
+	defer conn.Close()
+
+	count := int64(0)
+	ids := []string{}
+
+	err := this.scan(conn, this.pattern(prefix), func(keys []string) error {
+		for _, key := range keys {
+			id, ok := this.id(key)
+			if !ok {
+				continue
+			}
+			count++
+			if len(ids) < sample {
+				ids = append(ids, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("preview", prefix, err)
+		return 0, nil, err
+	}
+
+	return count, ids, nil
+}
+
+type (
+	// KeyInfo 会话键的元信息
+	KeyInfo struct {
+		ID   string
+		TTL  time.Duration //剩余时间，0表示不过期
+		Size int64         //占用内存字节数，近似值
+	}
+)
+
+// 会话列表带剩余时间和大小，一次调用满足管理界面的会话列表
+func (this *redisConnect) KeysInfo(prefix string) ([]KeyInfo, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	conn := this.get()
+	defer conn.Close()
+
+	infos := []KeyInfo{}
+
+	err := this.scan(conn, this.pattern(prefix), func(keys []string) error {
+		ids := []string{}
+		for _, key := range keys {
+			if id, ok := this.id(key); ok {
+				ids = append(ids, id)
+				conn.Send("PTTL", key)
+				conn.Send("MEMORY", "USAGE", key)
+			}
+		}
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			ttl, err := redis.Int64(conn.Receive())
+			if err != nil {
+				return err
+			}
+			size, err := redis.Int64(conn.Receive())
+			if err != nil && err != redis.ErrNil {
+				return err
+			}
+
+			//扫描之后已经不存在了
+			if ttl == -2 {
+				continue
+			}
+			info := KeyInfo{ID: id, Size: size}
+			if ttl > 0 {
+				info.TTL = time.Duration(ttl) * time.Millisecond
+			}
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("keysinfo", prefix, err)
+		return nil, err
+	}
+
+	return infos, nil
+}
@@ -0,0 +1,63 @@
+package session_redis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+// 抽样审计，按 audit_sample 的比例（比如 0.01 为 1%）记录 Read、Write、Delete，
+// 会话ID只记哈希，带数据大小和耗时，量不大又能留下排查线索
+// 配置 auditor 时交给它处理，否则写到驱动日志
+type (
+	// AuditRecord 一条审计记录
+	AuditRecord struct {
+		Op       string
+		Key      string //会话ID的 SHA-256 前16位
+		Size     int
+		Duration time.Duration
+		Error    error
+		Time     time.Time
+	}
+
+	// Auditor 处理审计记录
+	Auditor func(record AuditRecord)
+)
+
+// 解析 auditor 配置
+func parseAuditor(setting Map) Auditor {
+	switch vv := setting["auditor"].(type) {
+	case Auditor:
+		return vv
+	case func(AuditRecord):
+		return vv
+	}
+	return nil
+}
+
+// 是否抽中，抽中时返回开始时间
+func (this *redisConnect) sampling() (time.Time, bool) {
+	if this.setting.AuditSample <= 0 || rand.Float64() >= this.setting.AuditSample {
+		return time.Time{}, false
+	}
+	return time.Now(), true
+}
+
+// 记录一条审计
+func (this *redisConnect) audit(op, id string, size int, start time.Time, err error) {
+	sum := sha256.Sum256([]byte(id))
+	record := AuditRecord{
+		Op: op, Key: hex.EncodeToString(sum[:8]), Size: size,
+		Duration: time.Since(start), Error: err, Time: start,
+	}
+
+	this.metric("audit", 1)
+	if this.auditor != nil {
+		this.auditor(record)
+		return
+	}
+	this.warning("session.redis.audit", record.Op, record.Key, record.Size, record.Duration, record.Error)
+}
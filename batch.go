@@ -0,0 +1,324 @@
+package session_redis
+
+import (
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 批量命令，集群模式下按节点分组，每个节点一个管道、一次往返，再按键合并结果
+// 管道里的重定向不会自动处理，遇到 MOVED/ASK 的键单独再执行一次
+func (this *redisConnect) pipeline(keys []string, reading bool, command func(key string) (string, []Any), fn func(key string, reply Any, err error) error) error {
+	for _, group := range this.clusterGroups(keys) {
+		if len(group) == 0 {
+			continue
+		}
+
+		var conn redis.Conn
+		if reading {
+			conn = this.read(group[0])
+		} else {
+			conn = this.conn(group[0])
+		}
+
+		for _, key := range group {
+			cmd, args := command(key)
+			conn.Send(cmd, args...)
+		}
+		if err := conn.Flush(); err != nil {
+			conn.Close()
+			return err
+		}
+
+		replies := make([]Any, len(group))
+		errs := make([]error, len(group))
+		for i := range group {
+			replies[i], errs[i] = conn.Receive()
+		}
+		conn.Close()
+
+		for i, key := range group {
+			reply, err := replies[i], errs[i]
+			if _, _, ok := parseRedirect(err); ok {
+				retry := this.conn(key)
+				cmd, args := command(key)
+				reply, err = retry.Do(cmd, args...)
+				retry.Close()
+			}
+			if err := fn(key, reply, err); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 批量查询会话是否存在，管道执行，一次往返
+func (this *redisConnect) ExistsMulti(ids []string) (results map[string]bool, err error) {
+	err = this.intercept("existsmulti", "", func() error {
+		results, err = this.existsMulti(ids)
+		return err
+	})
+	return results, err
+}
+
+func (this *redisConnect) existsMulti(ids []string) (map[string]bool, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	results := make(map[string]bool, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	keys, index := this.batchKeys(ids)
+	err := this.pipeline(keys, true, func(key string) (string, []Any) {
+		return "EXISTS", []Any{key}
+	}, func(key string, reply Any, err error) error {
+		exists, err := redis.Int(reply, err)
+		if err != nil {
+			this.failed("exists", index[key], err)
+			return err
+		}
+		results[index[key]] = exists > 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// 批量读取会话，不存在的不在结果里
+func (this *redisConnect) ReadMulti(ids []string) (results map[string][]byte, err error) {
+	err = this.intercept("readmulti", "", func() error {
+		results, err = this.readMulti(ids)
+		return err
+	})
+	return results, err
+}
+
+func (this *redisConnect) readMulti(ids []string) (map[string][]byte, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	results := make(map[string][]byte, len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	//先查维护窗口的队列、还没落盘的合并写入和客户端缓存，和 Read 一致
+	missed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if data, ok := this.queued(id); ok {
+			if data != nil {
+				results[id] = data
+			}
+			continue
+		}
+		if data, ok := this.coalesced(id); ok {
+			results[id] = data
+			continue
+		}
+		if data, ok := this.cached(this.key(id)); ok {
+			results[id] = data
+		} else {
+			missed = append(missed, id)
+		}
+	}
+	if len(missed) == 0 {
+		return results, nil
+	}
+	sequence := this.cacheSequence()
+
+	keys, index := this.batchKeys(missed)
+	err := this.pipeline(keys, true, func(key string) (string, []Any) {
+		return "GET", []Any{key}
+	}, func(key string, reply Any, err error) error {
+		value, err := redis.String(reply, err)
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			this.failed("read", index[key], err)
+			return err
+		}
+		if value == this.tombstone() {
+			return nil
+		}
+		data, err := this.decode(index[key], value)
+		if err != nil {
+			//隔离成功的按不存在处理
+			if err := this.quarantine(index[key], value, err); err != nil && err != ErrNotFound {
+				return err
+			}
+			return nil
+		}
+		this.caching(key, data, sequence)
+		results[index[key]] = data
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+// 批量写入会话，需要逐个维护的功能开启时退回逐个写入
+func (this *redisConnect) WriteMulti(values map[string][]byte, expire time.Duration) error {
+	return this.intercept("writemulti", "", func() error {
+		return this.writeMulti(values, expire)
+	})
+}
+
+func (this *redisConnect) writeMulti(values map[string][]byte, expire time.Duration) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	if !this.batchable(false) {
+		for id, data := range values {
+			if err := this.save(id, data, expire); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	//先全部编码，有一个不合法就都不写
+	encoded := make(map[string]string, len(values))
+	ids := make([]string, 0, len(values))
+	empties := []string{}
+	for id, data := range values {
+		data, err := this.validate(id, data)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			if this.setting.Empty == emptyReject {
+				return errEmptyData
+			}
+			empties = append(empties, id)
+			continue
+		}
+		value, err := this.marshal(id, data, false)
+		if err != nil {
+			return err
+		}
+		if value, err = this.limit(id, data, value); err != nil {
+			return err
+		}
+		encoded[id] = value
+		ids = append(ids, id)
+	}
+
+	keys, index := this.batchKeys(ids)
+	this.uncache(keys...)
+	err := this.pipeline(keys, false, func(key string) (string, []Any) {
+		args := []Any{key, encoded[index[key]]}
+		if expire > 0 {
+			args = append(args, "PX", expire.Milliseconds())
+		}
+		return "SET", args
+	}, func(key string, reply Any, err error) error {
+		if err != nil {
+			this.failed("write", index[key], err)
+			return err
+		}
+		this.metric("session.write", 1)
+		this.emit(EventWrite, index[key], expire)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//空数据按策略逐个处理
+	for _, id := range empties {
+		if err := this.save(id, nil, expire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 批量删除会话，需要逐个维护的功能开启时退回逐个删除
+func (this *redisConnect) DeleteMulti(ids []string) error {
+	return this.intercept("deletemulti", "", func() error {
+		return this.deleteMulti(ids)
+	})
+}
+
+func (this *redisConnect) deleteMulti(ids []string) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if !this.batchable(true) {
+		for _, id := range ids {
+			if err := this.del(id); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	keys, index := this.batchKeys(ids)
+	this.uncache(keys...)
+	return this.pipeline(keys, false, func(key string) (string, []Any) {
+		return "DEL", []Any{key}
+	}, func(key string, reply Any, err error) error {
+		deleted, err := redis.Int(reply, err)
+		if err != nil {
+			this.failed("delete", index[key], err)
+			return err
+		}
+		if deleted > 0 {
+			this.metric("session.delete", 1)
+			this.emit(EventDelete, index[key], 0)
+		}
+		return nil
+	})
+}
+
+// 能不能走管道批量读写，租户配额、二级索引、维护窗口、写入合并、历史、超长键、软删除
+// 都要逐个会话维护，开启任何一个都退回逐个 save、del
+func (this *redisConnect) batchable(deleting bool) bool {
+	if this.setting.Tenant || this.setting.Index || this.setting.Coalesce > 0 || this.setting.MaxKeyLength > 0 {
+		return false
+	}
+	if deleting && this.setting.SoftDelete > 0 {
+		return false
+	}
+	if !deleting && this.setting.History > 0 {
+		return false
+	}
+	return !this.Maintaining()
+}
+
+// 会话ID转存储键，同时返回存储键到会话ID的对应
+func (this *redisConnect) batchKeys(ids []string) ([]string, map[string]string) {
+	keys := make([]string, 0, len(ids))
+	index := make(map[string]string, len(ids))
+	for _, id := range ids {
+		key := this.key(id)
+		if _, ok := index[key]; ok {
+			continue
+		}
+		keys = append(keys, key)
+		index[key] = id
+	}
+	return keys, index
+}
@@ -0,0 +1,109 @@
+package session_redis
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+func TestWriteMultiPipeline(t *testing.T) {
+	conn, server := testConnect(t, nil)
+
+	values := map[string][]byte{"a": []byte("1"), "b": []byte("2")}
+	if err := conn.WriteMulti(values, time.Minute); err != nil {
+		t.Fatalf("write multi: %v", err)
+	}
+
+	results, err := conn.ReadMulti([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatalf("read multi: %v", err)
+	}
+	if string(results["a"]) != "1" || string(results["b"]) != "2" {
+		t.Fatalf("unexpected results %q", results)
+	}
+	if _, ok := results["c"]; ok {
+		t.Fatalf("missing session returned")
+	}
+	if ttl := server.TTL("a"); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected ttl %v", ttl)
+	}
+
+	if err := conn.DeleteMulti([]string{"a", "b"}); err != nil {
+		t.Fatalf("delete multi: %v", err)
+	}
+	if server.Exists("a") || server.Exists("b") {
+		t.Fatalf("sessions not deleted")
+	}
+}
+
+func TestWriteMultiValidates(t *testing.T) {
+	conn, server := testConnect(t, nil)
+
+	rejected := errors.New("rejected")
+	conn.OnValidate(func(id string, data []byte) ([]byte, error) {
+		if id == "bad" {
+			return nil, rejected
+		}
+		return data, nil
+	})
+
+	err := conn.WriteMulti(map[string][]byte{"good": []byte("1"), "bad": []byte("2")}, 0)
+	if !errors.Is(err, rejected) {
+		t.Fatalf("expected validator error, got %v", err)
+	}
+	//有一个不合法就都不写
+	if server.Exists("good") || server.Exists("bad") {
+		t.Fatalf("batch partially written")
+	}
+}
+
+func TestMultiFallsBackPerSession(t *testing.T) {
+	conn, server := testConnect(t, Map{"soft_delete": time.Hour, "history": int64(2)})
+
+	if err := conn.WriteMulti(map[string][]byte{"a": []byte("1")}, 0); err != nil {
+		t.Fatalf("write multi: %v", err)
+	}
+	if err := conn.WriteMulti(map[string][]byte{"a": []byte("2")}, 0); err != nil {
+		t.Fatalf("write multi: %v", err)
+	}
+	//历史逐个记录
+	if history, _ := server.List(conn.historyKey("a")); len(history) != 1 {
+		t.Fatalf("expected one history entry, got %q", history)
+	}
+
+	//软删除逐个转储到回收键
+	if err := conn.DeleteMulti([]string{"a"}); err != nil {
+		t.Fatalf("delete multi: %v", err)
+	}
+	if server.Exists("a") || !server.Exists(conn.trashKey("a")) {
+		t.Fatalf("session not moved to trash")
+	}
+}
+
+func TestReadMultiSeesPendingWrites(t *testing.T) {
+	conn, server := testConnect(t, nil)
+
+	if err := conn.Write("a", []byte("old"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.BeginMaintenance()
+	if err := conn.Write("a", []byte("new"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Write("b", []byte("queued"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	results, err := conn.ReadMulti([]string{"a", "b"})
+	if err != nil {
+		t.Fatalf("read multi: %v", err)
+	}
+	if string(results["a"]) != "new" || string(results["b"]) != "queued" {
+		t.Fatalf("queued writes not visible: %q", results)
+	}
+	if server.Exists("b") {
+		t.Fatalf("queued write reached the server")
+	}
+}
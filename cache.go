@@ -0,0 +1,205 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 客户端缓存，基于 CLIENT TRACKING 的失效通知
+// redigo 只支持 RESP2，所以用 REDIRECT 模式：单独一个连接订阅 __redis__:invalidate，
+// 连接池里的每个连接建立时都把失效通知重定向到这个连接
+const (
+	invalidateChannel = "__redis__:invalidate"
+)
+
+type (
+	redisCache struct {
+		mutex    sync.RWMutex
+		entries  map[string]cacheEntry
+		sequence int64 //失效序号，读取期间有失效发生时不写入缓存
+		enabled  bool
+		clientID int64
+		server   string
+		conn     redis.Conn
+	}
+	cacheEntry struct {
+		data   []byte
+		expire time.Time
+	}
+)
+
+// 打开失效通知连接
+func (this *redisConnect) openCache() error {
+	server := this.server()
+	conn, err := this.dial(server)
+	if err != nil {
+		return err
+	}
+
+	id, err := redis.Int64(conn.Do("CLIENT", "ID"))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if err := conn.Send("SUBSCRIBE", invalidateChannel); err != nil {
+		conn.Close()
+		return err
+	}
+	if err := conn.Flush(); err != nil {
+		conn.Close()
+		return err
+	}
+
+	this.cache.mutex.Lock()
+	this.cache.entries = map[string]cacheEntry{}
+	this.cache.clientID = id
+	this.cache.server = server
+	this.cache.conn = conn
+	this.cache.enabled = true
+	this.cache.mutex.Unlock()
+
+	this.waiter.Add(1)
+	go this.invalidating(conn)
+
+	return nil
+}
+
+// 关闭失效通知连接，Receive 会随之返回
+func (this *redisConnect) closeCache() {
+	this.cache.mutex.Lock()
+	conn := this.cache.conn
+	this.cache.conn = nil
+	this.cache.enabled = false
+	this.cache.entries = nil
+	this.cache.mutex.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// 接收失效通知
+func (this *redisConnect) invalidating(conn redis.Conn) {
+	defer this.waiter.Done()
+
+	for {
+		reply, err := conn.Receive()
+		if err != nil {
+			select {
+			case <-this.done:
+			default:
+				//通知连接断开后无法保证缓存一致，直接停用
+				this.failed("cache", "", err)
+				this.closeCache()
+			}
+			return
+		}
+
+		vals, ok := reply.([]interface{})
+		if !ok || len(vals) < 3 {
+			continue
+		}
+		if kind, _ := redis.String(vals[0], nil); kind != "message" {
+			continue
+		}
+
+		//nil 表示服务器执行了 FLUSHALL/FLUSHDB
+		if vals[2] == nil {
+			this.uncache()
+			continue
+		}
+		keys, _ := redis.Strings(vals[2], nil)
+		this.uncache(keys...)
+	}
+}
+
+// 连接建立时开启跟踪
+func (this *redisConnect) tracking(conn redis.Conn, server string) error {
+	this.cache.mutex.RLock()
+	id, cacheServer, enabled := this.cache.clientID, this.cache.server, this.cache.enabled
+	this.cache.mutex.RUnlock()
+
+	if !enabled || id <= 0 {
+		return nil
+	}
+	if server != cacheServer {
+		//主服务器切换后失效通知连接还在旧服务器上，缓存没法再保证一致
+		if server == this.server() {
+			this.warning("session.redis.cache", "server switched, cache disabled")
+			this.closeCache()
+		}
+		return nil
+	}
+	_, err := conn.Do("CLIENT", "TRACKING", "ON", "REDIRECT", id)
+	return err
+}
+
+// 读缓存
+func (this *redisConnect) cached(key string) ([]byte, bool) {
+	this.cache.mutex.RLock()
+	defer this.cache.mutex.RUnlock()
+
+	if !this.cache.enabled {
+		return nil, false
+	}
+	entry, ok := this.cache.entries[key]
+	if !ok || time.Now().After(entry.expire) {
+		return nil, false
+	}
+
+	data := make([]byte, len(entry.data))
+	copy(data, entry.data)
+	return data, true
+}
+
+// 当前失效序号
+func (this *redisConnect) cacheSequence() int64 {
+	this.cache.mutex.RLock()
+	defer this.cache.mutex.RUnlock()
+	return this.cache.sequence
+}
+
+// 写缓存，sequence 和读取前不一致说明期间有失效，不写入
+func (this *redisConnect) caching(key string, data []byte, sequence int64) {
+	this.cache.mutex.Lock()
+	defer this.cache.mutex.Unlock()
+
+	if !this.cache.enabled || this.cache.sequence != sequence {
+		return
+	}
+
+	//满了随便淘汰一个
+	if len(this.cache.entries) >= this.setting.CacheSize {
+		for k := range this.cache.entries {
+			delete(this.cache.entries, k)
+			break
+		}
+	}
+
+	value := make([]byte, len(data))
+	copy(value, data)
+	this.cache.entries[key] = cacheEntry{
+		data: value, expire: time.Now().Add(this.setting.CacheTTL),
+	}
+}
+
+// 失效，不传键时清空
+func (this *redisConnect) uncache(keys ...string) {
+	this.cache.mutex.Lock()
+	defer this.cache.mutex.Unlock()
+
+	if !this.cache.enabled {
+		return
+	}
+
+	this.cache.sequence++
+	if len(keys) == 0 {
+		this.cache.entries = map[string]cacheEntry{}
+		return
+	}
+	for _, key := range keys {
+		delete(this.cache.entries, key)
+	}
+}
@@ -0,0 +1,100 @@
+package session_redis
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 自检，Open 时用探针键完整走一遍 写入、读取、过期、删除，PING 只能说明连得上
+// 编码、加密密钥、ACL 权限、maxmemory 策略这些配置错了，在启动时就暴露出来，设置了 canary_interval 时后台定时自检
+const (
+	canaryTTL = time.Second * 10
+)
+
+var (
+	errCanaryMismatch = errors.New("Session canary read back different data.")
+	errCanaryExpire   = errors.New("Session canary expire not set.")
+)
+
+// 自检一次，只读模式下跳过
+func (this *redisConnect) Canary() error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if this.ReadOnly() {
+		return nil
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	name := ""
+	if this.instance != nil {
+		name = this.instance.Name
+	}
+	key := this.setting.CanaryPrefix + name + ":" + hex.EncodeToString(token[:8])
+
+	conn := this.conn(key)
+	defer conn.Close()
+
+	//探针键没有租户，按默认密钥加密
+	value, err := this.marshal("", token, false)
+	if err != nil {
+		return fmt.Errorf("Session canary failed to encode: %v", err)
+	}
+	if _, err := conn.Do("SET", key, value, "PX", canaryTTL.Milliseconds()); err != nil {
+		return fmt.Errorf("Session canary failed to write: %v", err)
+	}
+	//中途失败时清掉探针键
+	removed := false
+	defer func() {
+		if !removed {
+			conn.Do("DEL", key)
+		}
+	}()
+
+	stored, err := redis.String(conn.Do("GET", key))
+	if err != nil {
+		return fmt.Errorf("Session canary failed to read: %v", err)
+	}
+	data, err := this.decode("", stored)
+	if err != nil {
+		return fmt.Errorf("Session canary failed to decode: %v", err)
+	}
+	if !bytes.Equal(data, token) {
+		return errCanaryMismatch
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil {
+		return fmt.Errorf("Session canary failed to read expire: %v", err)
+	}
+	if ttl <= 0 {
+		return errCanaryExpire
+	}
+
+	deleted, err := redis.Int(conn.Do("DEL", key))
+	if err != nil {
+		return fmt.Errorf("Session canary failed to delete: %v", err)
+	}
+	removed = true
+	if deleted != 1 {
+		return fmt.Errorf("Session canary failed to delete: %d keys removed.", deleted)
+	}
+	return nil
+}
+
+// 后台定时自检，失败只记录，不影响服务
+func (this *redisConnect) canary() {
+	if err := this.Canary(); err != nil {
+		this.metric("canary.failed", 1)
+		this.failed("canary", "", err)
+	}
+}
@@ -0,0 +1,157 @@
+package session_redis
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 服务器能力，Open 时按版本号检测一次，功能按能力选用最合适的命令
+// 检测不到时按全部支持处理，仍然保留运行时遇到 unknown command 的退回
+var redisCommandVersions = map[string][3]int{
+	"UNLINK": {4, 0, 0},
+	"GETEX":  {6, 2, 0},
+	"GETDEL": {6, 2, 0},
+}
+
+type (
+	redisCapabilities struct {
+		mutex    sync.RWMutex
+		detected bool
+		version  [3]int
+		text     string
+		commands map[string]bool
+	}
+)
+
+// 检测服务器版本
+func (this *redisConnect) detect(conn redis.Conn) {
+	info, err := redis.String(conn.Do("INFO", "server"))
+	if err != nil {
+		return
+	}
+	text := infoString(info, "redis_version")
+	if text == "" {
+		return
+	}
+	version := parseVersion(text)
+
+	commands := map[string]bool{}
+	for cmd, since := range redisCommandVersions {
+		commands[cmd] = versionAtLeast(version, since)
+	}
+
+	this.capabilities.mutex.Lock()
+	this.capabilities.detected = true
+	this.capabilities.version = version
+	this.capabilities.text = text
+	this.capabilities.commands = commands
+	this.capabilities.mutex.Unlock()
+}
+
+// 命令能不能用，被禁用的不能用，检测过版本的按版本，没检测到的当作可用
+func (this *redisConnect) capable(cmd string) bool {
+	if this.disabled(strings.Fields(cmd)[0]) {
+		return false
+	}
+
+	this.capabilities.mutex.RLock()
+	defer this.capabilities.mutex.RUnlock()
+
+	if !this.capabilities.detected {
+		return true
+	}
+	if supported, ok := this.capabilities.commands[cmd]; ok {
+		return supported
+	}
+	return true
+}
+
+// 检测到的服务器能力，version 为空表示没有检测到
+func (this *redisConnect) Capabilities() Map {
+	this.capabilities.mutex.RLock()
+	defer this.capabilities.mutex.RUnlock()
+
+	commands := Map{}
+	for cmd, supported := range this.capabilities.commands {
+		commands[cmd] = supported
+	}
+	return Map{
+		"version": this.capabilities.text, "commands": commands,
+	}
+}
+
+// 检查 min_version，服务器版本太低时一并列出开启的功能各自需要的版本，不要等到第一次使用才报奇怪的错
+func (this *redisConnect) checkVersion() error {
+	if this.setting.MinVersion == "" {
+		return nil
+	}
+
+	this.capabilities.mutex.RLock()
+	detected, version, text := this.capabilities.detected, this.capabilities.version, this.capabilities.text
+	this.capabilities.mutex.RUnlock()
+
+	if !detected {
+		return fmt.Errorf("Session server version unknown, min_version %s required.", this.setting.MinVersion)
+	}
+
+	features := []struct {
+		on    bool
+		name  string
+		since [3]int
+	}{
+		{this.setting.Username != "", "username (ACL)", [3]int{6, 0, 0}},
+		{this.setting.Cache, "cache (CLIENT TRACKING)", [3]int{6, 0, 0}},
+		{this.setting.NoEvict, "no_evict (CLIENT NO-EVICT)", [3]int{7, 0, 0}},
+		{this.setting.NoTouch, "no_touch (CLIENT NO-TOUCH)", [3]int{7, 2, 0}},
+	}
+	newer := []string{}
+	for _, feature := range features {
+		if feature.on && !versionAtLeast(version, feature.since) {
+			newer = append(newer, fmt.Sprintf("%s requires %d.%d", feature.name, feature.since[0], feature.since[1]))
+		}
+	}
+
+	if !versionAtLeast(version, parseVersion(this.setting.MinVersion)) {
+		newer = append([]string{"min_version " + this.setting.MinVersion}, newer...)
+	}
+	if len(newer) > 0 {
+		return fmt.Errorf("Session server version %s too old, %s.", text, strings.Join(newer, ", "))
+	}
+	return nil
+}
+
+// INFO 输出里的字符串字段
+func infoString(info, field string) string {
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, field+":") {
+			return strings.TrimPrefix(line, field+":")
+		}
+	}
+	return ""
+}
+
+// 版本号，比如 6.2.14，缺的部分按0
+func parseVersion(text string) [3]int {
+	version := [3]int{}
+	for i, part := range strings.SplitN(text, ".", 3) {
+		value, _ := strconv.Atoi(strings.TrimFunc(part, func(r rune) bool { return r < '0' || r > '9' }))
+		version[i] = value
+	}
+	return version
+}
+
+func versionAtLeast(version, since [3]int) bool {
+	for i := 0; i < 3; i++ {
+		if version[i] != since[i] {
+			return version[i] > since[i]
+		}
+	}
+	return true
+}
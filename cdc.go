@@ -0,0 +1,151 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+// 变更捕获，会话的每次写入、删除、续期都作为事件投递到外部，分析和安全系统可以消费会话生命周期
+// 事件先在内存里排队，按 sink_interval 分批投递，投递失败留在队列里下次重试，至少投递一次
+// 队列满了丢弃新事件并计数 sink.dropped，关闭时把剩下的事件再投递一次
+const (
+	EventWrite  = "write"
+	EventDelete = "delete"
+	EventExpire = "expire"
+)
+
+type (
+	// Event 会话变更事件
+	Event struct {
+		Op     string
+		ID     string
+		Expire time.Duration //写入和续期的过期时间，0表示不过期
+		Time   time.Time
+	}
+
+	// Sink 事件投递，Kafka、NATS 之类由应用实现，返回错误时整批重试
+	Sink interface {
+		Publish(events []Event) error
+	}
+
+	// SinkFunc 用函数作为 Sink
+	SinkFunc func(events []Event) error
+
+	redisSink struct {
+		sink   Sink
+		mutex  sync.Mutex
+		events []Event
+	}
+
+	// 内置的 Redis Stream，写到同一个服务器
+	streamSink struct {
+		connect *redisConnect
+		stream  string
+		maxlen  int64
+	}
+)
+
+func (fn SinkFunc) Publish(events []Event) error {
+	return fn(events)
+}
+
+// 解析 sink 配置，sink 为 Sink 或者 func([]Event) error，sink_stream 为内置 Redis Stream 的键
+func (this *redisConnect) parseSink(setting Map) {
+	switch vv := setting["sink"].(type) {
+	case Sink:
+		this.sink.sink = vv
+	case func([]Event) error:
+		this.sink.sink = SinkFunc(vv)
+	}
+	if vv, ok := setting["sink_stream"].(string); ok && vv != "" && this.sink.sink == nil {
+		stream := &streamSink{connect: this, stream: vv}
+		if max, ok := setting["sink_maxlen"].(int64); ok && max > 0 {
+			stream.maxlen = max
+		}
+		this.sink.sink = stream
+	}
+}
+
+// 登记事件
+func (this *redisConnect) emit(op, id string, expire time.Duration) {
+	if this.sink.sink == nil {
+		return
+	}
+
+	this.sink.mutex.Lock()
+	defer this.sink.mutex.Unlock()
+
+	if len(this.sink.events) >= this.setting.SinkQueue {
+		this.metric("sink.dropped", 1)
+		return
+	}
+	this.sink.events = append(this.sink.events, Event{Op: op, ID: id, Expire: expire, Time: time.Now()})
+}
+
+// 分批投递，只有后台任务和关闭时调用，不会并发
+func (this *redisConnect) publishEvents() {
+	if this.sink.sink == nil {
+		return
+	}
+
+	for {
+		this.sink.mutex.Lock()
+		size := len(this.sink.events)
+		if size > this.setting.SinkBatch {
+			size = this.setting.SinkBatch
+		}
+		batch := append([]Event{}, this.sink.events[:size]...)
+		this.sink.mutex.Unlock()
+
+		if len(batch) == 0 {
+			return
+		}
+		if err := this.sink.sink.Publish(batch); err != nil {
+			this.metric("sink.failed", 1)
+			this.failed("sink", "", err)
+			return
+		}
+
+		this.sink.mutex.Lock()
+		this.sink.events = this.sink.events[size:]
+		this.sink.mutex.Unlock()
+		this.metric("sink.published", int64(size))
+	}
+}
+
+func (s *streamSink) Publish(events []Event) error {
+	conn := s.connect.conn(s.stream)
+	defer conn.Close()
+
+	for _, event := range events {
+		args := []Any{s.stream}
+		if s.maxlen > 0 {
+			args = append(args, "MAXLEN", "~", s.maxlen)
+		}
+		args = append(args, "*",
+			"op", event.Op, "id", event.ID,
+			"expire", event.Expire.Milliseconds(), "time", event.Time.UnixNano()/int64(time.Millisecond),
+		)
+		if err := conn.Send("XADD", args...); err != nil {
+			return err
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	for range events {
+		if _, err := conn.Receive(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 批量删除的事件
+func (this *redisConnect) emitDeletes(ids []string) {
+	for _, id := range ids {
+		this.emit(EventDelete, id, 0)
+	}
+}
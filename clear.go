@@ -0,0 +1,101 @@
+package session_redis
+
+import (
+	"sync"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 并行清理，扫描照常按节点进行，扫描到的批次交给 clear_workers 个删除协程，各自用自己的连接
+// 集群模式下各主节点同时扫描，任意一批出错就停止
+func (this *redisConnect) clearParallel(prefix string, progress *redisProgress) error {
+	batches := make(chan []string, this.setting.ClearWorkers*2)
+	stop := make(chan struct{})
+
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			close(stop)
+		})
+	}
+
+	//删除
+	workers := sync.WaitGroup{}
+	for i := 0; i < this.setting.ClearWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range batches {
+				conn := this.conn(batch[0])
+				deleted, err := this.unlink(conn, batch)
+				conn.Close()
+				if err == nil {
+					err = progress.report(int64(len(batch)), deleted, 0)
+				}
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	//扫描
+	scanners := sync.WaitGroup{}
+	scanning := func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			for _, group := range this.slots(keys) {
+				for _, batch := range chunks(group, this.setting.DeleteBatch) {
+					if len(batch) == 0 {
+						continue
+					}
+					//扫描的切片会被复用，交出去之前复制
+					select {
+					case batches <- append([]string{}, batch...):
+					case <-stop:
+						return errStopped
+					}
+				}
+			}
+			return nil
+		})
+	}
+
+	if this.setting.Cluster {
+		addrs := this.clusterMasters()
+		if len(addrs) == 0 {
+			close(batches)
+			workers.Wait()
+			return errNoClusterNode
+		}
+		for _, addr := range addrs {
+			scanners.Add(1)
+			go func(addr string) {
+				defer scanners.Done()
+				conn := &redirectConn{Conn: this.borrow(this.node(addr)), connect: this}
+				defer conn.Close()
+				if err := scanning(conn); err != nil && err != errStopped {
+					fail(err)
+				}
+			}(addr)
+		}
+	} else {
+		scanners.Add(1)
+		go func() {
+			defer scanners.Done()
+			conn := this.get()
+			defer conn.Close()
+			if err := scanning(conn); err != nil && err != errStopped {
+				fail(err)
+			}
+		}()
+	}
+
+	scanners.Wait()
+	close(batches)
+	workers.Wait()
+
+	return first
+}
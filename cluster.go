@@ -0,0 +1,271 @@
+package session_redis
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 集群模式，按 CLUSTER SLOTS 的槽位表把命令直接发到对应的主节点
+// 定时刷新槽位表，遇到 MOVED 或者连接失败时也会刷新，两次刷新之间至少间隔 ClusterRefreshMin
+// 扩缩容和节点替换不需要重启
+const (
+	clusterSlots = 16384
+)
+
+var (
+	errNoClusterNode = errors.New("No available cluster node.")
+)
+
+type (
+	redisCluster struct {
+		mutex   sync.RWMutex
+		slots   [clusterSlots]string
+		masters []string
+
+		refreshing int32
+		refreshed  int64 //上次刷新时间，纳秒
+	}
+)
+
+// 按键取连接，非集群模式就是主连接池
+func (this *redisConnect) conn(key string) redis.Conn {
+	if pool := this.routed(key); pool != nil {
+		return &redirectConn{Conn: this.borrow(pool), connect: this}
+	}
+	if !this.setting.Cluster {
+		return this.get()
+	}
+
+	this.cluster.mutex.RLock()
+	addr := this.cluster.slots[slot(key)]
+	this.cluster.mutex.RUnlock()
+
+	if addr == "" {
+		this.clusterRefreshSoon()
+		return this.get()
+	}
+
+	conn := this.borrow(this.node(addr))
+	if conn.Err() != nil {
+		this.clusterRefreshSoon()
+	}
+	return &redirectConn{Conn: conn, connect: this}
+}
+
+// 刷新槽位表，依次问已知的主节点和配置的种子节点
+func (this *redisConnect) clusterRefresh() error {
+	this.cluster.mutex.RLock()
+	addrs := append([]string{}, this.cluster.masters...)
+	this.cluster.mutex.RUnlock()
+	addrs = append(addrs, this.server())
+
+	var lastErr error = errNoClusterNode
+	for _, addr := range addrs {
+		conn := this.borrow(this.node(addr))
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		slots := [clusterSlots]string{}
+		masters := []string{}
+		seen := map[string]bool{}
+
+		for _, item := range reply {
+			vals, err := redis.Values(item, nil)
+			if err != nil || len(vals) < 3 {
+				continue
+			}
+			start, _ := redis.Int(vals[0], nil)
+			end, _ := redis.Int(vals[1], nil)
+			node, err := redis.Values(vals[2], nil)
+			if err != nil || len(node) < 2 {
+				continue
+			}
+			host, _ := redis.String(node[0], nil)
+			port, _ := redis.Int(node[1], nil)
+			//空主机名表示就是应答的这个节点
+			if host == "" {
+				host, _, _ = net.SplitHostPort(addr)
+			}
+			master := net.JoinHostPort(host, strconv.Itoa(port))
+
+			for i := start; i <= end && i < clusterSlots; i++ {
+				slots[i] = master
+			}
+			if !seen[master] {
+				seen[master] = true
+				masters = append(masters, master)
+			}
+		}
+
+		this.cluster.mutex.Lock()
+		this.cluster.slots = slots
+		this.cluster.masters = masters
+		this.cluster.mutex.Unlock()
+
+		atomic.StoreInt64(&this.cluster.refreshed, time.Now().UnixNano())
+		return nil
+	}
+
+	return lastErr
+}
+
+// 出错时触发的刷新，异步执行，并且限制频率，避免 MOVED 风暴时反复刷新
+func (this *redisConnect) clusterRefreshSoon() {
+	last := atomic.LoadInt64(&this.cluster.refreshed)
+	if time.Since(time.Unix(0, last)) < this.setting.ClusterRefreshMin {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&this.cluster.refreshing, 0, 1) {
+		return
+	}
+
+	go func() {
+		defer atomic.StoreInt32(&this.cluster.refreshing, 0)
+		if err := this.clusterRefresh(); err != nil {
+			this.failed("cluster", "", err)
+		}
+	}()
+}
+
+// 当前的主节点
+func (this *redisConnect) clusterMasters() []string {
+	this.cluster.mutex.RLock()
+	defer this.cluster.mutex.RUnlock()
+	return append([]string{}, this.cluster.masters...)
+}
+
+// 键所在的槽位，有 {hashtag} 时只算 hashtag
+func slot(key string) int {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '{' {
+			for j := i + 1; j < len(key); j++ {
+				if key[j] == '}' {
+					if j > i+1 {
+						key = key[i+1 : j]
+					}
+					break
+				}
+			}
+			break
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// CRC16-CCITT (XMODEM)
+func crc16(key string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(key); i++ {
+		crc ^= uint16(key[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// 在每个主节点上执行，集群模式下 SCAN、KEYS 只能按节点分别执行，其它情况只有一个节点
+func (this *redisConnect) masters(fn func(conn redis.Conn) error) error {
+	return this.eachMaster(func(addr string, conn redis.Conn) error {
+		return fn(conn)
+	})
+}
+
+// 同 masters，同时给出节点地址
+func (this *redisConnect) eachMaster(fn func(addr string, conn redis.Conn) error) error {
+	if !this.setting.Cluster {
+		conn := this.get()
+		err := fn(this.server(), conn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+
+		//路由的服务器
+		for server, pool := range this.routeServers() {
+			conn := &redirectConn{Conn: this.borrow(pool), connect: this}
+			err := fn(server, conn)
+			conn.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	addrs := this.clusterMasters()
+	if len(addrs) == 0 {
+		return errNoClusterNode
+	}
+	for _, addr := range addrs {
+		conn := &redirectConn{Conn: this.borrow(this.node(addr)), connect: this}
+		err := fn(addr, conn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 按槽位分组，多键命令在集群里只能作用在同一个槽位
+func (this *redisConnect) slots(keys []string) [][]string {
+	if !this.setting.Cluster {
+		return [][]string{keys}
+	}
+
+	groups := map[int][]string{}
+	order := []int{}
+	for _, key := range keys {
+		s := slot(key)
+		if _, ok := groups[s]; !ok {
+			order = append(order, s)
+		}
+		groups[s] = append(groups[s], key)
+	}
+
+	batches := make([][]string, 0, len(order))
+	for _, s := range order {
+		batches = append(batches, groups[s])
+	}
+	return batches
+}
+
+// 按所在节点分组，同一节点上的单键命令可以放在一个管道里
+func (this *redisConnect) clusterGroups(keys []string) [][]string {
+	if !this.setting.Cluster {
+		return this.routeGroups(keys)
+	}
+
+	this.cluster.mutex.RLock()
+	groups := map[string][]string{}
+	order := []string{}
+	for _, key := range keys {
+		addr := this.cluster.slots[slot(key)]
+		if _, ok := groups[addr]; !ok {
+			order = append(order, addr)
+		}
+		groups[addr] = append(groups[addr], key)
+	}
+	this.cluster.mutex.RUnlock()
+
+	batches := make([][]string, 0, len(order))
+	for _, addr := range order {
+		batches = append(batches, groups[addr])
+	}
+	return batches
+}
@@ -0,0 +1,110 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+)
+
+// 写入合并，很多框架每个请求都会整体写回会话，热点会话在窗口内的多次写入只落最后一次
+// 写入立即返回，落盘失败走 OnError，读取优先返回还没落盘的数据
+// 租户会话要同步检查配额，不合并
+type (
+	redisCoalesce struct {
+		mutex   sync.Mutex
+		pending map[string]*coalescedWrite
+	}
+	coalescedWrite struct {
+		data   []byte
+		value  string
+		expire time.Duration
+		timer  *time.Timer
+	}
+)
+
+// 登记合并写入，窗口内再次写入只替换内容，不延后落盘时间
+func (this *redisConnect) coalesce(id string, data []byte, value string, expire time.Duration) {
+	this.coalescing.mutex.Lock()
+	defer this.coalescing.mutex.Unlock()
+
+	if this.coalescing.pending == nil {
+		this.coalescing.pending = map[string]*coalescedWrite{}
+	}
+	if write, ok := this.coalescing.pending[id]; ok {
+		write.data, write.value, write.expire = data, value, expire
+		this.metric("coalesce.merged", 1)
+		return
+	}
+
+	write := &coalescedWrite{data: data, value: value, expire: expire}
+	write.timer = time.AfterFunc(this.setting.Coalesce, func() {
+		this.flush(id)
+	})
+	this.coalescing.pending[id] = write
+}
+
+// 还没落盘的数据
+func (this *redisConnect) coalesced(id string) ([]byte, bool) {
+	if this.setting.Coalesce <= 0 {
+		return nil, false
+	}
+
+	this.coalescing.mutex.Lock()
+	defer this.coalescing.mutex.Unlock()
+
+	if write, ok := this.coalescing.pending[id]; ok {
+		return write.data, true
+	}
+	return nil, false
+}
+
+// 取消还没落盘的写入，删除会话时用
+func (this *redisConnect) uncoalesce(id string) {
+	if this.setting.Coalesce <= 0 {
+		return
+	}
+
+	this.coalescing.mutex.Lock()
+	defer this.coalescing.mutex.Unlock()
+
+	if write, ok := this.coalescing.pending[id]; ok {
+		write.timer.Stop()
+		delete(this.coalescing.pending, id)
+	}
+}
+
+// 落盘单个会话，Update、ReadOnce 这类直接读写服务器的操作之前也要先落盘
+func (this *redisConnect) flush(id string) {
+	if this.setting.Coalesce <= 0 {
+		return
+	}
+
+	this.coalescing.mutex.Lock()
+	write, ok := this.coalescing.pending[id]
+	if ok {
+		write.timer.Stop()
+		delete(this.coalescing.pending, id)
+	}
+	this.coalescing.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := this.persist(id, write.value, write.expire); err != nil {
+		this.metric("coalesce.failed", 1)
+		this.failed("coalesce", id, err)
+	}
+}
+
+// 全部落盘，关闭前和 Clear 之前用
+func (this *redisConnect) flushAll() {
+	this.coalescing.mutex.Lock()
+	ids := make([]string, 0, len(this.coalescing.pending))
+	for id := range this.coalescing.pending {
+		ids = append(ids, id)
+	}
+	this.coalescing.mutex.Unlock()
+
+	for _, id := range ids {
+		this.flush(id)
+	}
+}
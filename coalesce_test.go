@@ -0,0 +1,81 @@
+package session_redis
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+func TestCoalesceDelaysWrite(t *testing.T) {
+	conn, server := testConnect(t, Map{"coalesce": time.Hour})
+
+	if err := conn.Write("a", []byte("1"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Write("a", []byte("2"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if server.Exists("a") {
+		t.Fatalf("coalesced write reached the server")
+	}
+	//还没落盘时读到的是最后一次写入
+	if data := testRead(t, conn, "a"); string(data) != "2" {
+		t.Fatalf("unexpected data %q", data)
+	}
+
+	conn.flushAll()
+	if value, _ := server.Get("a"); value != conn.encode([]byte("2")) {
+		t.Fatalf("unexpected stored value %q", value)
+	}
+}
+
+func TestCoalesceDeleteCancelsWrite(t *testing.T) {
+	conn, server := testConnect(t, Map{"coalesce": time.Hour})
+
+	if err := conn.Write("a", []byte("1"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	//删除之后合并的写入不能再落盘
+	conn.flushAll()
+	if server.Exists("a") {
+		t.Fatalf("deleted session resurrected by a pending write")
+	}
+}
+
+func TestCoalesceClearCancelsWrites(t *testing.T) {
+	conn, server := testConnect(t, Map{"coalesce": time.Hour})
+
+	for _, id := range []string{"a", "b"} {
+		if err := conn.Write(id, []byte("1"), 0); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := conn.Clear(""); err != nil {
+		t.Fatalf("clear: %v", err)
+	}
+
+	conn.flushAll()
+	if server.Exists("a") || server.Exists("b") {
+		t.Fatalf("cleared sessions resurrected by pending writes")
+	}
+}
+
+func TestCoalesceDeleteIfSeesPendingWrite(t *testing.T) {
+	conn, server := testConnect(t, Map{"coalesce": time.Hour})
+
+	if err := conn.Write("a", []byte("token"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deleted, err := conn.DeleteIf("a", []byte("token"))
+	if err != nil {
+		t.Fatalf("delete if: %v", err)
+	}
+	if !deleted || server.Exists("a") {
+		t.Fatalf("pending write not compared")
+	}
+}
@@ -0,0 +1,105 @@
+package session_redis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+)
+
+// 会话数据信封，魔数 + 标记 + 数据
+// 没有魔数的都是旧格式，直接就是会话数据
+const (
+	envelopeMagic = "\x1eSR"
+
+	flagGzip byte = 1 << iota
+	flagEncrypt
+	flagBound //密文绑定了会话ID，复制到别的会话下解不开
+)
+
+var (
+	errInvalidEnvelope = errors.New("Invalid session envelope.")
+)
+
+// 编码要写入的会话数据，开启加密时总是加密，密钥按会话所属租户选
+func (this *redisConnect) marshal(id string, data []byte, compress bool) (string, error) {
+	flags := byte(0)
+	if compress {
+		flags |= flagGzip
+	}
+	if this.encrypted() {
+		flags |= flagEncrypt | flagBound
+	}
+	//数据本身以魔数开头时也要套信封，不然读的时候会被当成信封解
+	if flags == 0 && !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return this.encode(data), nil
+	}
+
+	packed, err := this.pack(id, data, flags)
+	if err != nil {
+		return "", err
+	}
+	return this.encode(packed), nil
+}
+
+// 打包，按标记处理数据，先压缩再加密
+func (this *redisConnect) pack(id string, data []byte, flags byte) ([]byte, error) {
+	body := data
+	if flags&flagGzip != 0 {
+		buf := bytes.Buffer{}
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	if flags&flagEncrypt != 0 {
+		sealed, err := this.encrypt(id, body, flags&flagBound != 0)
+		if err != nil {
+			return nil, err
+		}
+		body = sealed
+	}
+
+	out := make([]byte, 0, len(envelopeMagic)+1+len(body))
+	out = append(out, envelopeMagic...)
+	out = append(out, flags)
+	out = append(out, body...)
+	return out, nil
+}
+
+// 解包，不是信封格式的原样返回，id 为会话ID，加密时绑定过的要一致才解得开
+func (this *redisConnect) unpack(id string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(envelopeMagic)) {
+		return data, nil
+	}
+	if len(data) < len(envelopeMagic)+1 {
+		return nil, errInvalidEnvelope
+	}
+
+	flags := data[len(envelopeMagic)]
+	body := data[len(envelopeMagic)+1:]
+
+	if flags&flagEncrypt != 0 {
+		opened, err := this.decrypt(id, body, flags&flagBound != 0)
+		if err != nil {
+			return nil, err
+		}
+		body = opened
+	}
+	if flags&flagGzip != 0 {
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		if body, err = ioutil.ReadAll(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	return body, nil
+}
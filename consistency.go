@@ -0,0 +1,321 @@
+package session_redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 索引一致性检查，二级索引用来撤销用户的全部会话，索引和会话键对不上就会漏掉
+// 逐项对比过期索引、归属哈希、用户集合和实际的会话键，repair 为 true 时顺便修复
+const (
+	indexReportLimit = 1000            //每类问题最多列出的ID数
+	indexDriftMargin = time.Second * 5 //过期索引和实际过期时间允许的误差
+)
+
+type (
+	// IndexReport 索引一致性检查的结果，每类最多列出 1000 个，超出时 Truncated 为 true
+	IndexReport struct {
+		Checked    int64    //检查的会话键数
+		Orphans    []string //索引里有，会话键已经不存在
+		Unindexed  []string //会话键存在，不在过期索引里
+		Drifted    []string //过期索引的时间和会话键的实际过期时间不一致
+		Mismatched []string //归属哈希和用户集合互相对不上
+		Repaired   int64    //修复的条目数
+		Truncated  bool
+
+		seen map[*[]string]map[string]bool
+	}
+)
+
+// 记一个有问题的ID，几个方向的检查会发现同一个问题，不重复记
+func (report *IndexReport) note(list *[]string, id string) {
+	if report.seen == nil {
+		report.seen = map[*[]string]map[string]bool{}
+	}
+	if report.seen[list] == nil {
+		report.seen[list] = map[string]bool{}
+	}
+	if report.seen[list][id] {
+		return
+	}
+	if len(*list) >= indexReportLimit {
+		report.Truncated = true
+		return
+	}
+	report.seen[list][id] = true
+	*list = append(*list, id)
+}
+
+// 检查索引和会话键的一致性
+func (this *redisConnect) AuditIndex(repair bool) (IndexReport, error) {
+	report := IndexReport{Orphans: []string{}, Unindexed: []string{}, Drifted: []string{}, Mismatched: []string{}}
+	if this.client == nil {
+		return report, errInvalidCacheConnection
+	}
+	if !this.setting.Index {
+		return report, errIndexDisabled
+	}
+	if repair {
+		if err := this.writable(); err != nil {
+			return report, err
+		}
+	}
+
+	index := this.conn(this.indexKey(indexExpiry))
+	defer index.Close()
+
+	//会话键到过期索引
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(""), func(keys []string) error {
+			ids := []string{}
+			for _, key := range keys {
+				if id, ok := this.id(key); ok {
+					ids = append(ids, id)
+				}
+			}
+			ids = this.originals(conn, ids)
+			return this.auditKeys(conn, index, ids, repair, &report)
+		})
+	})
+	if err != nil {
+		this.failed("auditindex", "", err)
+		return report, err
+	}
+
+	//过期索引到会话键
+	err = this.cursor(index, "ZSCAN", this.indexKey(indexExpiry), func(items []string) error {
+		ids := []string{}
+		for i := 0; i+1 < len(items); i += 2 {
+			ids = append(ids, items[i])
+		}
+		return this.auditOrphans(index, ids, repair, &report)
+	})
+	if err != nil {
+		this.failed("auditindex", "", err)
+		return report, err
+	}
+
+	//归属哈希到用户集合
+	err = this.cursor(index, "HSCAN", this.indexKey(indexOwner), func(items []string) error {
+		for i := 0; i+1 < len(items); i += 2 {
+			id, user := items[i], items[i+1]
+			exists, err := redis.Int(index.Do("EXISTS", this.key(id)))
+			if err != nil {
+				return err
+			}
+			if exists == 0 {
+				report.note(&report.Orphans, id)
+				if repair {
+					this.indexRemove(id)
+					report.Repaired++
+				}
+				continue
+			}
+			member, err := redis.Int(index.Do("SISMEMBER", this.indexKey(indexUser+user), id))
+			if err != nil {
+				return err
+			}
+			if member == 0 {
+				report.note(&report.Mismatched, id)
+				if repair {
+					if _, err := index.Do("SADD", this.indexKey(indexUser+user), id); err != nil {
+						return err
+					}
+					report.Repaired++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("auditindex", "", err)
+		return report, err
+	}
+
+	//用户集合到归属哈希
+	prefix := this.indexKey(indexUser)
+	err = this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, prefix+"*", func(keys []string) error {
+			for _, key := range keys {
+				user := key[len(prefix):]
+				err := this.cursor(index, "SSCAN", key, func(ids []string) error {
+					for _, id := range ids {
+						owner, err := redis.String(index.Do("HGET", this.indexKey(indexOwner), id))
+						if err != nil && err != redis.ErrNil {
+							return err
+						}
+						if owner == user {
+							continue
+						}
+						report.note(&report.Mismatched, id)
+						if repair {
+							if _, err := index.Do("SREM", key, id); err != nil {
+								return err
+							}
+							report.Repaired++
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		this.failed("auditindex", "", err)
+		return report, err
+	}
+
+	this.metric("auditindex.repaired", report.Repaired)
+	this.warning("session.redis.auditindex", report.Checked, len(report.Orphans), len(report.Unindexed), len(report.Drifted), len(report.Mismatched), report.Repaired)
+	return report, nil
+}
+
+// 一批会话键对照过期索引，会话键在扫描的节点上，索引在索引所在的节点上，分开两个管道
+func (this *redisConnect) auditKeys(conn, index redis.Conn, ids []string, repair bool, report *IndexReport) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	for _, id := range ids {
+		conn.Send("PTTL", this.key(id))
+	}
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+	ttls := make([]int64, len(ids))
+	for i := range ids {
+		ms, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return err
+		}
+		ttls[i] = ms
+	}
+
+	for _, id := range ids {
+		index.Send("ZSCORE", this.indexKey(indexExpiry), id)
+	}
+	if err := index.Flush(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	type fix struct {
+		id     string
+		expire time.Duration
+	}
+	fixes := []fix{}
+	for i, id := range ids {
+		ms := ttls[i]
+		score, err := redis.String(index.Receive())
+		if err != nil && err != redis.ErrNil {
+			return err
+		}
+		if ms == -2 {
+			continue
+		}
+		report.Checked++
+
+		expire := time.Duration(0)
+		if ms > 0 {
+			expire = time.Duration(ms) * time.Millisecond
+		}
+		if err == redis.ErrNil {
+			report.note(&report.Unindexed, id)
+			fixes = append(fixes, fix{id, expire})
+			continue
+		}
+		if drifted(score, expire, now) {
+			report.note(&report.Drifted, id)
+			fixes = append(fixes, fix{id, expire})
+		}
+	}
+
+	if repair {
+		for _, fix := range fixes {
+			this.indexWrite(fix.id, fix.expire)
+			report.Repaired++
+		}
+	}
+	return nil
+}
+
+// 一批过期索引成员对照会话键
+func (this *redisConnect) auditOrphans(index redis.Conn, ids []string, repair bool, report *IndexReport) error {
+	for _, id := range ids {
+		index.Send("EXISTS", this.key(id))
+	}
+	if err := index.Flush(); err != nil {
+		return err
+	}
+
+	orphans := []string{}
+	for _, id := range ids {
+		exists, err := redis.Int(index.Receive())
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			orphans = append(orphans, id)
+			report.note(&report.Orphans, id)
+		}
+	}
+
+	if repair {
+		for _, id := range orphans {
+			this.indexRemove(id)
+			report.Repaired++
+		}
+	}
+	return nil
+}
+
+// 过期索引的分数和实际过期时间是否对不上，expire 为 0 表示不过期
+func drifted(score string, expire time.Duration, now time.Time) bool {
+	if score == "inf" || score == "+inf" {
+		return expire > 0
+	}
+	if expire <= 0 {
+		return true
+	}
+	value, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return true
+	}
+	expected := now.Add(expire).UnixNano() / int64(time.Millisecond)
+	diff := time.Duration(int64(value)-expected) * time.Millisecond
+	return diff > indexDriftMargin || diff < -indexDriftMargin
+}
+
+// ZSCAN、HSCAN、SSCAN 游标遍历
+func (this *redisConnect) cursor(conn redis.Conn, command, key string, fn func(items []string) error) error {
+	cursor := "0"
+	for {
+		vals, err := redis.Values(conn.Do(command, key, cursor, "COUNT", this.setting.ScanCount))
+		if err != nil {
+			return err
+		}
+		if len(vals) < 2 {
+			return nil
+		}
+
+		cursor, _ = redis.String(vals[0], nil)
+		items, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			return err
+		}
+		if len(items) > 0 {
+			if err := fn(items); err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package session_redis
+
+import (
+	"errors"
+	"strings"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Active-Active（CRDB）模式，多地域双向复制的 Redis Enterprise 数据库
+// 只允许冲突可以自动合并的命令，Lua 脚本和 WATCH 乐观锁在各地域本地执行，跨地域没有保证，一律拒绝
+// 删除按 observed-remove 处理，和其它地域的并发写入冲突时写入胜出，删除不存在的键也不算失败
+// 因此依赖脚本的租户配额、限流、序列、DeleteIf、Update，以及客户端缓存、集群模式都不能用
+// 软删除、快照、历史版本、隔离、读取续期、分片亲和也都靠脚本，在 Connect 时拒绝
+var crdbCommands = map[string]bool{
+	"PING": true, "AUTH": true, "SELECT": true, "CLIENT": true, "ECHO": true, "INFO": true,
+	"GET": true, "MGET": true, "SET": true, "DEL": true, "UNLINK": true, "EXISTS": true, "GETDEL": true,
+	"GETRANGE": true, "SETRANGE": true, "APPEND": true, "INCRBY": true, "STRLEN": true,
+	"EXPIRE": true, "PEXPIRE": true, "PEXPIREAT": true, "TTL": true, "PTTL": true,
+	"SCAN": true, "KEYS": true, "TYPE": true, "MEMORY": true, "OBJECT": true,
+	"MULTI": true, "EXEC": true,
+	"ZADD": true, "ZREM": true, "ZCARD": true, "ZCOUNT": true, "ZRANGEBYSCORE": true, "ZREMRANGEBYSCORE": true,
+	"HGET": true, "HGETALL": true, "HSET": true, "HDEL": true, "HSCAN": true,
+	"SADD": true, "SREM": true, "SMEMBERS": true,
+}
+
+var (
+	errCRDBCommand = errors.New("Command not supported in session crdb mode.")
+)
+
+type (
+	// 拒绝 CRDB 不支持的命令
+	crdbConn struct {
+		redis.Conn
+	}
+)
+
+func (c *crdbConn) Do(cmd string, args ...Any) (Any, error) {
+	if cmd != "" && !crdbCommands[strings.ToUpper(cmd)] {
+		return nil, errCRDBCommand
+	}
+	return c.Conn.Do(cmd, args...)
+}
+
+func (c *crdbConn) Send(cmd string, args ...Any) error {
+	if !crdbCommands[strings.ToUpper(cmd)] {
+		return errCRDBCommand
+	}
+	return c.Conn.Send(cmd, args...)
+}
+
+func crdbMiddleware(c redis.Conn) redis.Conn {
+	return &crdbConn{Conn: c}
+}
+
+// CRDB 模式下不能同时开启的功能
+func checkCRDB(setting redisSetting) error {
+	switch {
+	case setting.Tenant:
+		return errors.New("Invalid session crdb setting, tenant quota requires scripts.")
+	case setting.Cache:
+		return errors.New("Invalid session crdb setting, client cache not supported.")
+	case setting.Cluster:
+		return errors.New("Invalid session crdb setting, cluster mode not supported.")
+	case setting.SoftDelete > 0:
+		return errors.New("Invalid session crdb setting, soft delete requires scripts.")
+	case setting.Snapshot:
+		return errors.New("Invalid session crdb setting, snapshot requires scripts.")
+	case setting.History > 0:
+		return errors.New("Invalid session crdb setting, history requires scripts.")
+	case setting.Quarantine:
+		return errors.New("Invalid session crdb setting, quarantine requires scripts.")
+	case setting.RefreshTTL > 0:
+		return errors.New("Invalid session crdb setting, refresh ttl requires scripts.")
+	case setting.Shard:
+		return errors.New("Invalid session crdb setting, shard requires scripts.")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package session_redis
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 老版本服务器的降级，同一份配置在整个集群不同版本的 Redis 上都能用
+// 按 Open 时检测到的能力选命令，没检测到时先试新命令，unknown command 再退回
+//
+//	功能          6.2 及以上        退回
+//	读取并续期     GETEX PX          MULTI GET+PEXPIRE
+//	读取并删除     GETDEL            MULTI GET+DEL
+//	批量删除       UNLINK            DEL，4.0 以下或被禁用
+//	服务端脚本     EVALSHA           EVAL，脚本不用 FUNCTION，7.0 以下同样可用
+//	客户端缓存     CLIENT TRACKING   6.0 以下不能开启，见 min_version
+
+// 读取会话并把过期时间重置为 expire，滑动过期的会话每次读取顺便续期，省一次往返
+func (this *redisConnect) ReadTouch(id string, expire time.Duration) (data []byte, err error) {
+	err = this.intercept("readtouch", id, func() error {
+		data, err = this.readTouch(id, expire)
+		return err
+	})
+	return data, err
+}
+
+func (this *redisConnect) readTouch(id string, expire time.Duration) ([]byte, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	//只读时不续期，维护窗口中排队的会话按排队的数据返回，重放时按排队的过期时间写入
+	if expire <= 0 || this.ReadOnly() {
+		return this.load(id)
+	}
+	if _, ok := this.queued(id); ok {
+		return this.load(id)
+	}
+	this.flush(id)
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	key := this.key(id)
+
+	var value string
+	var err error
+	if !this.capable("GETEX") {
+		value, err = this.getexpire(conn, key, expire)
+	} else {
+		value, err = redis.String(conn.Do("GETEX", key, "PX", expire.Milliseconds()))
+		if err != nil && isUnknownCommand(err) {
+			value, err = this.getexpire(conn, key, expire)
+		}
+	}
+	if err == redis.ErrNil {
+		return nil, this.missing()
+	}
+	if err != nil {
+		this.failed("readtouch", id, err)
+		return nil, err
+	}
+
+	this.emit(EventExpire, id, expire)
+
+	//租户和索引的过期时间同步更新
+	ms := time.Now().Add(expire).UnixNano() / int64(time.Millisecond)
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZADD", this.tenantKey(tenant), "XX", ms, id); err != nil {
+			this.failed("readtouch", id, err)
+		}
+	}
+	if this.setting.Index {
+		if _, err := conn.Do("ZADD", this.indexKey(indexExpiry), "XX", ms, id); err != nil {
+			this.failed("readtouch", id, err)
+		}
+	}
+
+	if value == this.tombstone() {
+		return nil, this.missing()
+	}
+	if value == "" {
+		return []byte{}, nil
+	}
+	data, err := this.decode(id, value)
+	if err != nil {
+		return nil, this.quarantine(id, value, err)
+	}
+	return data, nil
+}
+
+// 事务方式的 GET+PEXPIRE
+func (this *redisConnect) getexpire(conn redis.Conn, key string, expire time.Duration) (string, error) {
+	conn.Send("MULTI")
+	conn.Send("GET", key)
+	conn.Send("PEXPIRE", key, expire.Milliseconds())
+	vals, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	if len(vals) == 0 {
+		return "", redis.ErrNil
+	}
+	return redis.String(vals[0], nil)
+}
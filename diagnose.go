@@ -0,0 +1,196 @@
+package session_redis
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 会话驱动用到的命令，SLOWLOG 里只挑这些
+var sessionCommands = map[string]bool{
+	"GET": true, "MGET": true, "SET": true, "DEL": true, "UNLINK": true, "EXISTS": true,
+	"GETDEL": true, "GETEX": true, "GETRANGE": true, "SETRANGE": true, "APPEND": true, "INCRBY": true,
+	"EXPIRE": true, "PEXPIRE": true, "PEXPIREAT": true, "PTTL": true, "SCAN": true, "KEYS": true,
+	"EVAL": true, "EVALSHA": true, "EXEC": true, "HGET": true, "HGETALL": true, "HSET": true, "HDEL": true,
+	"ZADD": true, "ZREM": true, "ZCOUNT": true, "ZRANGEBYSCORE": true, "ZREMRANGEBYSCORE": true,
+	"MEMORY": true, "OBJECT": true,
+}
+
+type (
+	// LatencyEvent LATENCY LATEST 的一项
+	LatencyEvent struct {
+		Node   string
+		Event  string
+		Time   time.Time //最近一次超过阈值的时间
+		Latest time.Duration
+		Max    time.Duration
+	}
+
+	// SlowEntry SLOWLOG 的一条
+	SlowEntry struct {
+		Node     string
+		ID       int64
+		Time     time.Time
+		Duration time.Duration
+		Command  string
+		Args     []string //参数，服务器本身会截断过长的参数
+		Client   string
+	}
+
+	// Diagnostics 给支持工具用的延迟诊断
+	Diagnostics struct {
+		Latency []LatencyEvent
+		Slowlog []SlowEntry
+	}
+)
+
+// 拉取 LATENCY LATEST 和最近 count 条 SLOWLOG，SLOWLOG 只保留会话命令
+// 集群模式下每个主节点都取，被托管服务禁用的命令跳过
+func (this *redisConnect) Diagnose(count int) (Diagnostics, error) {
+	diagnostics := Diagnostics{Latency: []LatencyEvent{}, Slowlog: []SlowEntry{}}
+	if this.client == nil {
+		return diagnostics, errInvalidCacheConnection
+	}
+	if count <= 0 {
+		count = 128
+	}
+
+	err := this.eachMaster(func(node string, conn redis.Conn) error {
+		if !this.disabled("LATENCY") {
+			events, err := redis.Values(conn.Do("LATENCY", "LATEST"))
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				fields, err := redis.Values(event, nil)
+				if err != nil || len(fields) < 4 {
+					continue
+				}
+				name, _ := redis.String(fields[0], nil)
+				at, _ := redis.Int64(fields[1], nil)
+				latest, _ := redis.Int64(fields[2], nil)
+				max, _ := redis.Int64(fields[3], nil)
+				diagnostics.Latency = append(diagnostics.Latency, LatencyEvent{
+					Node: node, Event: name, Time: time.Unix(at, 0),
+					Latest: time.Duration(latest) * time.Millisecond, Max: time.Duration(max) * time.Millisecond,
+				})
+			}
+		}
+
+		if !this.disabled("SLOWLOG") {
+			entries, err := redis.Values(conn.Do("SLOWLOG", "GET", count))
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				if slow, ok := parseSlowEntry(entry); ok && sessionCommands[slow.Command] {
+					slow.Node = node
+					diagnostics.Slowlog = append(diagnostics.Slowlog, slow)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("diagnose", "", err)
+		return diagnostics, err
+	}
+
+	return diagnostics, nil
+}
+
+// SLOWLOG 条目，id、时间戳、微秒耗时、命令参数，4.0 起还有客户端地址和名称
+func parseSlowEntry(entry Any) (SlowEntry, bool) {
+	fields, err := redis.Values(entry, nil)
+	if err != nil || len(fields) < 4 {
+		return SlowEntry{}, false
+	}
+
+	slow := SlowEntry{}
+	slow.ID, _ = redis.Int64(fields[0], nil)
+	at, _ := redis.Int64(fields[1], nil)
+	slow.Time = time.Unix(at, 0)
+	micros, _ := redis.Int64(fields[2], nil)
+	slow.Duration = time.Duration(micros) * time.Microsecond
+
+	args, _ := redis.Strings(fields[3], nil)
+	if len(args) == 0 {
+		return SlowEntry{}, false
+	}
+	slow.Command = strings.ToUpper(args[0])
+	slow.Args = args[1:]
+	if len(fields) > 4 {
+		slow.Client, _ = redis.String(fields[4], nil)
+	}
+	return slow, true
+}
+
+// 允许透传的 MEMORY 子命令，只有只读的报告类，PURGE 这种会改服务器状态的不允许
+var memoryReports = map[string]bool{
+	"STATS": true, "DOCTOR": true,
+}
+
+var (
+	errMemoryReport = errors.New("Invalid session memory report, stats or doctor only.")
+)
+
+// MEMORY STATS 或 MEMORY DOCTOR 的快照，按节点地址返回，应用可以据此做 session doctor 之类的管理命令
+// STATS 的每个字段原样返回，嵌套的字段（比如 db.0）是 Map，DOCTOR 返回 report 文本
+func (this *redisConnect) MemoryReport(report string) (Map, error) {
+	report = strings.ToUpper(report)
+	if !memoryReports[report] {
+		return nil, errMemoryReport
+	}
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	reports := Map{}
+	err := this.eachMaster(func(node string, conn redis.Conn) error {
+		if report == "DOCTOR" {
+			text, err := redis.String(conn.Do("MEMORY", "DOCTOR"))
+			if err != nil {
+				return err
+			}
+			reports[node] = Map{"report": text}
+			return nil
+		}
+
+		values, err := redis.Values(conn.Do("MEMORY", "STATS"))
+		if err != nil {
+			return err
+		}
+		reports[node] = memoryFields(values)
+		return nil
+	})
+	if err != nil {
+		this.failed("memory", report, err)
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// 键值交替的应答转成 Map
+func memoryFields(values []Any) Map {
+	fields := Map{}
+	for i := 0; i+1 < len(values); i += 2 {
+		name, err := redis.String(values[i], nil)
+		if err != nil {
+			continue
+		}
+		switch value := values[i+1].(type) {
+		case []byte:
+			fields[name] = string(value)
+		case []Any:
+			fields[name] = memoryFields(value)
+		default:
+			fields[name] = value
+		}
+	}
+	return fields
+}
@@ -0,0 +1,68 @@
+package session_redis
+
+import (
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// Dialer 替换默认的建立连接，测试时可以注入故障连接或者录制连接，不需要真实网络
+	// 建立后仍然会执行 AUTH、SELECT 等握手命令
+	Dialer func() (redis.Conn, error)
+
+	// ConnMiddleware 包装建立好的连接，按配置的顺序依次包装
+	ConnMiddleware func(redis.Conn) redis.Conn
+)
+
+// 解析 dialer 配置
+func parseDialer(setting Map) Dialer {
+	switch vv := setting["dialer"].(type) {
+	case Dialer:
+		return vv
+	case func() (redis.Conn, error):
+		return vv
+	}
+	return nil
+}
+
+// 解析 middleware 配置，可以是单个也可以是列表
+func parseMiddlewares(setting Map) []ConnMiddleware {
+	middlewares := []ConnMiddleware{}
+	add := func(value Any) {
+		switch vv := value.(type) {
+		case ConnMiddleware:
+			middlewares = append(middlewares, vv)
+		case func(redis.Conn) redis.Conn:
+			middlewares = append(middlewares, vv)
+		}
+	}
+
+	switch vv := setting["middleware"].(type) {
+	case []ConnMiddleware:
+		middlewares = append(middlewares, vv...)
+	case []Any:
+		for _, item := range vv {
+			add(item)
+		}
+	default:
+		add(vv)
+	}
+	return middlewares
+}
+
+// 建立网络连接，配置了 dialer 时用 dialer
+func (this *redisConnect) network(server string, options ...redis.DialOption) (redis.Conn, error) {
+	if this.dialer != nil {
+		return this.dialer()
+	}
+	return redis.Dial("tcp", server, options...)
+}
+
+// 用中间件包装连接
+func (this *redisConnect) wrap(c redis.Conn) redis.Conn {
+	for _, middleware := range this.middlewares {
+		c = middleware(c)
+	}
+	return c
+}
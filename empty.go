@@ -0,0 +1,38 @@
+package session_redis
+
+import (
+	"time"
+)
+
+// 写入空数据时的策略，不同的上层框架对清空但保留会话ID的处理不一样
+const (
+	emptyReject    = "reject"    //拒绝，返回错误，默认
+	emptyStore     = "store"     //照常存空值，读出来是空数据
+	emptyTombstone = "tombstone" //存一个墓碑，短时间保留会话ID，读出来按不存在处理
+	emptyDelete    = "delete"    //直接删除会话
+)
+
+// 墓碑标记，用信封魔数开头，不会和正常的会话数据冲突
+const tombstoneMarker = envelopeMagic + "\x00"
+
+// 墓碑编码后的值
+func (this *redisConnect) tombstone() string {
+	return this.encode([]byte(tombstoneMarker))
+}
+
+// 墓碑的过期时间，不超过会话本身的过期时间
+func (this *redisConnect) tombstoneExpire(expire time.Duration) time.Duration {
+	if expire <= 0 || expire > this.setting.TombstoneTTL {
+		return this.setting.TombstoneTTL
+	}
+	return expire
+}
+
+// 写入墓碑
+func (this *redisConnect) bury(id string, expire time.Duration) error {
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	this.uncache(this.key(id))
+	return this.store(conn, id, this.tombstone(), this.tombstoneExpire(expire))
+}
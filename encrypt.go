@@ -0,0 +1,285 @@
+package session_redis
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	. "github.com/infrago/base"
+)
+
+// 加密，AES-GCM，支持多把密钥
+// 信封里记录密钥ID，新写入用当前密钥，旧会话还能用旧密钥解开，轮换密钥不用让所有人重新登录
+var (
+	errInvalidCiphertext = errors.New("Invalid session ciphertext.")
+)
+
+var (
+	keyProvidersMutex sync.RWMutex
+	keyProviders      = map[string]KeyProvider{}
+)
+
+type (
+	// KeyProvider 加密密钥来源，可以是静态配置，也可以是 AWS KMS、GCP KMS、Vault transit 等
+	// 实现方自行缓存，驱动会按ID缓存解出来的密钥
+	KeyProvider interface {
+		GetKey(id string) ([]byte, error)
+		CurrentKey() (string, []byte, error)
+	}
+
+	// TenantKeyProvider 按租户选密钥，每个租户用自己的密钥加密
+	// 一个租户的密钥泄露或者下线销毁密钥（crypto-shredding）不影响其他租户，密钥ID要全局唯一
+	TenantKeyProvider interface {
+		KeyProvider
+		TenantKey(tenant string) (string, []byte, error)
+	}
+
+	redisKeyring struct {
+		provider KeyProvider
+		mutex    sync.RWMutex
+		aeads    map[string]cipher.AEAD
+	}
+
+	// 配置里的静态密钥
+	staticKeyProvider struct {
+		current string
+		keys    map[string][]byte
+		tenants map[string]string
+	}
+)
+
+// 注册密钥来源，实例配置 key_provider 指定名称使用
+func RegisterKeyProvider(name string, provider KeyProvider) {
+	keyProvidersMutex.Lock()
+	defer keyProvidersMutex.Unlock()
+	keyProviders[name] = provider
+}
+
+func (provider *staticKeyProvider) GetKey(id string) ([]byte, error) {
+	if key, ok := provider.keys[id]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("Unknown session encryption key %s.", id)
+}
+
+func (provider *staticKeyProvider) CurrentKey() (string, []byte, error) {
+	key, err := provider.GetKey(provider.current)
+	return provider.current, key, err
+}
+
+// 配置了 tenant_keys 的租户用自己的密钥，其他租户用当前密钥
+func (provider *staticKeyProvider) TenantKey(tenant string) (string, []byte, error) {
+	id, ok := provider.tenants[tenant]
+	if !ok {
+		return provider.CurrentKey()
+	}
+	key, err := provider.GetKey(id)
+	return id, key, err
+}
+
+// 解析密钥配置
+// key_provider 为注册的密钥来源名称或者直接是 KeyProvider
+// 否则用静态配置，encrypt_keys 为 ID 到 base64 密钥的映射，encrypt_key 为当前用于加密的ID
+// tenant_keys 为租户到密钥ID的映射，开启多租户时按租户选密钥
+func parseKeyring(setting Map) (*redisKeyring, error) {
+	switch vv := setting["key_provider"].(type) {
+	case KeyProvider:
+		return &redisKeyring{provider: vv, aeads: map[string]cipher.AEAD{}}, nil
+	case string:
+		if vv != "" {
+			keyProvidersMutex.RLock()
+			provider, ok := keyProviders[vv]
+			keyProvidersMutex.RUnlock()
+			if !ok {
+				return nil, fmt.Errorf("Unknown session key provider %s.", vv)
+			}
+			return &redisKeyring{provider: provider, aeads: map[string]cipher.AEAD{}}, nil
+		}
+	}
+
+	keys, ok := setting["encrypt_keys"].(Map)
+	if !ok || len(keys) == 0 {
+		return nil, nil
+	}
+
+	provider := &staticKeyProvider{keys: map[string][]byte{}}
+	for id, value := range keys {
+		if len(id) > 255 {
+			return nil, fmt.Errorf("Invalid session encryption key id %s.", id)
+		}
+		encoded, ok := value.(string)
+		if !ok {
+			return nil, fmt.Errorf("Invalid session encryption key %s.", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid session encryption key %s: %v", id, err)
+		}
+		if _, err := newAEAD(key); err != nil {
+			return nil, fmt.Errorf("Invalid session encryption key %s: %v", id, err)
+		}
+		provider.keys[id] = key
+	}
+
+	if current, ok := setting["encrypt_key"].(string); ok && current != "" {
+		provider.current = current
+	} else if len(provider.keys) == 1 {
+		for id := range provider.keys {
+			provider.current = id
+		}
+	}
+	if _, ok := provider.keys[provider.current]; !ok {
+		return nil, fmt.Errorf("Unknown session encryption key %s.", provider.current)
+	}
+
+	if tenants, ok := setting["tenant_keys"].(Map); ok {
+		provider.tenants = map[string]string{}
+		for tenant, value := range tenants {
+			id, _ := value.(string)
+			if _, ok := provider.keys[id]; !ok {
+				return nil, fmt.Errorf("Unknown session encryption key %s for tenant %s.", id, tenant)
+			}
+			provider.tenants[tenant] = id
+		}
+	}
+
+	return &redisKeyring{provider: provider, aeads: map[string]cipher.AEAD{}}, nil
+}
+
+// 按ID取 AEAD，key 为空时从密钥来源取
+func (ring *redisKeyring) aead(id string, key []byte) (cipher.AEAD, error) {
+	ring.mutex.RLock()
+	aead, ok := ring.aeads[id]
+	ring.mutex.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	if key == nil {
+		var err error
+		if key, err = ring.provider.GetKey(id); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ring.mutex.Lock()
+	ring.aeads[id] = aead
+	ring.mutex.Unlock()
+
+	return aead, nil
+}
+
+// 加密用的密钥，密钥来源支持按租户选密钥时用租户的密钥
+func (ring *redisKeyring) current(tenant string) (string, []byte, error) {
+	if provider, ok := ring.provider.(TenantKeyProvider); ok && tenant != "" {
+		return provider.TenantKey(tenant)
+	}
+	return ring.provider.CurrentKey()
+}
+
+// 丢掉缓存的密钥，租户密钥销毁后立即生效，不用等重启
+func (ring *redisKeyring) forget(ids ...string) {
+	ring.mutex.Lock()
+	defer ring.mutex.Unlock()
+	for _, id := range ids {
+		delete(ring.aeads, id)
+	}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 是否开启加密
+func (this *redisConnect) encrypted() bool {
+	return this.keyring != nil
+}
+
+// 销毁租户密钥后调用，清掉驱动缓存的密钥，之后用这些密钥加密的会话都无法解开
+func (this *redisConnect) ForgetKeys(ids ...string) {
+	if this.keyring != nil {
+		this.keyring.forget(ids...)
+	}
+}
+
+// 加密，输出 ID长度 + ID + nonce + 密文，密钥按会话所属租户选
+// bound 为 true 时附加数据里带上会话ID，密文换到别的会话下认证不过
+func (this *redisConnect) encrypt(session string, data []byte, bound bool) ([]byte, error) {
+	id, key, err := this.keyring.current(this.tenant(session))
+	if err != nil {
+		return nil, err
+	}
+	if len(id) > 255 {
+		return nil, fmt.Errorf("Invalid session encryption key id %s.", id)
+	}
+	aead, err := this.keyring.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, 1+len(id)+len(nonce)+len(data)+aead.Overhead())
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, data, additional(id, session, bound)), nil
+}
+
+// 解密，按信封里的密钥ID选密钥
+func (this *redisConnect) decrypt(session string, data []byte, bound bool) ([]byte, error) {
+	if this.keyring == nil || len(data) < 1 {
+		return nil, errInvalidCiphertext
+	}
+
+	size := int(data[0])
+	if len(data) < 1+size {
+		return nil, errInvalidCiphertext
+	}
+	id := string(data[1 : 1+size])
+	data = data[1+size:]
+
+	aead, err := this.keyring.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errInvalidCiphertext
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	//认证失败说明密文被改过，和取不到密钥区分开
+	opened, err := aead.Open(nil, nonce, ciphertext, additional(id, session, bound))
+	if err != nil {
+		return nil, errInvalidCiphertext
+	}
+	return opened, nil
+}
+
+// GCM 的附加数据，旧格式只有密钥ID，绑定会话的是 ID长度 + 密钥ID + 会话ID
+func additional(id, session string, bound bool) []byte {
+	if !bound {
+		return []byte(id)
+	}
+	out := make([]byte, 0, 1+len(id)+len(session))
+	out = append(out, byte(len(id)))
+	out = append(out, id...)
+	out = append(out, session...)
+	return out
+}
@@ -0,0 +1,282 @@
+package session_redis
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 被遗忘权，删除用户的全部会话和索引，返回一份删除回执
+// overwrite 为 true 时删除前先用同样长度的零字节覆盖一次
+// 配置了 erase_secret 时回执带 HMAC-SHA256 签名，合规流程可以校验回执没有被改过
+// 软删除和隔离的会话已经移出了用户集合，另外记在 retained 集合里，一起清掉
+const (
+	indexRetained = "retained:" //用户被软删除、隔离的会话ID
+	indexErased   = "erased:"   //用户执行 Erase 的时间，这之前软删除的会话不再恢复
+)
+
+type (
+	// ErasureReceipt 删除回执
+	ErasureReceipt struct {
+		User        string    `json:"user"`
+		Instance    string    `json:"instance"`
+		Sessions    []string  `json:"sessions"`
+		Snapshots   []string  `json:"snapshots,omitempty"` //一起删除的快照，会话ID:快照ID
+		Overwritten bool      `json:"overwritten"`
+		Time        time.Time `json:"time"`
+		Signature   string    `json:"signature,omitempty"`
+	}
+)
+
+// 删除用户的全部会话，需要开启二级索引
+func (this *redisConnect) Erase(user string, overwrite bool) (*ErasureReceipt, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return nil, err
+	}
+	if !this.setting.Index {
+		return nil, errIndexDisabled
+	}
+
+	ids, err := this.Sessions(user)
+	if err != nil {
+		return nil, err
+	}
+	retained, err := this.retained(user)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &ErasureReceipt{User: user, Sessions: []string{}, Overwritten: overwrite}
+	if this.instance != nil {
+		receipt.Instance = this.instance.Name
+	}
+
+	for _, id := range ids {
+		if overwrite {
+			if err := this.overwrite(id); err != nil {
+				this.failed("erase", id, err)
+				return nil, err
+			}
+		}
+		if err := this.drop(id, false); err != nil {
+			this.failed("erase", id, err)
+			return nil, err
+		}
+		snapshots, err := this.purge(id)
+		if err != nil {
+			this.failed("erase", id, err)
+			return nil, err
+		}
+		for _, snapshot := range snapshots {
+			receipt.Snapshots = append(receipt.Snapshots, id+":"+snapshot)
+		}
+		receipt.Sessions = append(receipt.Sessions, id)
+	}
+
+	//软删除、隔离的会话只剩附属键
+	live := map[string]bool{}
+	for _, id := range ids {
+		live[id] = true
+	}
+	for _, id := range retained {
+		if live[id] {
+			continue
+		}
+		snapshots, err := this.purge(id)
+		if err != nil {
+			this.failed("erase", id, err)
+			return nil, err
+		}
+		for _, snapshot := range snapshots {
+			receipt.Snapshots = append(receipt.Snapshots, id+":"+snapshot)
+		}
+		receipt.Sessions = append(receipt.Sessions, id)
+	}
+
+	//用户集合本身，记下执行的时间，之后 Restore 不再把这之前的会话关联回来
+	for _, key := range []string{this.indexKey(indexUser + user), this.indexKey(indexRetained + user)} {
+		conn := this.conn(key)
+		_, err = conn.Do("DEL", key)
+		conn.Close()
+		if err != nil {
+			this.failed("erase", user, err)
+			return nil, err
+		}
+	}
+	if this.setting.SoftDelete > 0 {
+		key := this.indexKey(indexErased + user)
+		conn := this.conn(key)
+		_, err = conn.Do("SET", key, time.Now().UnixNano()/int64(time.Millisecond), "PX", this.setting.SoftDelete.Milliseconds())
+		conn.Close()
+		if err != nil {
+			this.failed("erase", user, err)
+			return nil, err
+		}
+	}
+
+	receipt.Time = time.Now()
+	if this.setting.EraseSecret != "" {
+		receipt.Signature = receipt.sign(this.setting.EraseSecret)
+	}
+
+	this.metric("erase", 1)
+	this.warning("session.redis.erase", len(receipt.Sessions), overwrite)
+	return receipt, nil
+}
+
+// 用户被软删除、隔离的会话ID
+func (this *redisConnect) retained(user string) ([]string, error) {
+	key := this.indexKey(indexRetained + user)
+	conn := this.conn(key)
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", key))
+	if err != nil {
+		this.failed("erase", user, err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// 会话移出用户集合时记下来，保留到软删除和隔离都过期
+func (this *redisConnect) retain(user, id string) {
+	if !this.setting.Index || user == "" {
+		return
+	}
+	keep := this.setting.SoftDelete
+	if this.setting.Quarantine && this.setting.QuarantineTTL > keep {
+		keep = this.setting.QuarantineTTL
+	}
+
+	key := this.indexKey(indexRetained + user)
+	conn := this.conn(key)
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("SADD", key, id)
+	conn.Send("PEXPIRE", key, keep.Milliseconds())
+	if _, err := conn.Do("EXEC"); err != nil {
+		this.failed("retain", id, err)
+	}
+}
+
+// 会话所属的用户
+func (this *redisConnect) owner(id string) (string, error) {
+	conn := this.conn(this.indexKey(indexOwner))
+	defer conn.Close()
+
+	user, err := redis.String(conn.Do("HGET", this.indexKey(indexOwner), id))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return user, err
+}
+
+// 恢复以后会话回到用户集合里
+func (this *redisConnect) unretain(user, id string) {
+	key := this.indexKey(indexRetained + user)
+	conn := this.conn(key)
+	defer conn.Close()
+
+	if _, err := conn.Do("SREM", key, id); err != nil {
+		this.failed("retain", id, err)
+	}
+}
+
+// 用户在 at 毫秒之后是否执行过 Erase
+func (this *redisConnect) erasedSince(user string, at int64) (bool, error) {
+	key := this.indexKey(indexErased + user)
+	conn := this.conn(key)
+	defer conn.Close()
+
+	erased, err := redis.Int64(conn.Do("GET", key))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return erased >= at, nil
+}
+
+// 校验回执的签名
+func (receipt *ErasureReceipt) Verify(secret string) bool {
+	if receipt.Signature == "" || secret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(receipt.Signature), []byte(receipt.sign(secret)))
+}
+
+// 签名不含签名字段本身
+func (receipt *ErasureReceipt) sign(secret string) string {
+	unsigned := *receipt
+	unsigned.Signature = ""
+	body, _ := json.Marshal(unsigned)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 删除会话附带保留的旧数据，软删除的回收键、历史列表、隔离键和快照，返回删除的快照ID
+func (this *redisConnect) purge(id string) ([]string, error) {
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	keys := []Any{}
+	if this.setting.SoftDelete > 0 {
+		keys = append(keys, this.trashKey(id))
+	}
+	if this.setting.History > 0 {
+		keys = append(keys, this.historyKey(id))
+	}
+	if this.setting.Quarantine {
+		keys = append(keys, this.quarantineKey(id))
+	}
+	snapshots := []string{}
+	if this.setting.Snapshot {
+		var err error
+		if snapshots, err = this.snapshots(conn, id); err != nil {
+			return nil, err
+		}
+		for _, snapshot := range snapshots {
+			keys = append(keys, this.snapshotKey(id, snapshot))
+		}
+		keys = append(keys, this.snapshotsKey(id))
+	}
+	if len(keys) == 0 {
+		return snapshots, nil
+	}
+
+	//集群里这几个键和会话键在同一个槽位
+	if _, err := conn.Do("DEL", keys...); err != nil {
+		return nil, err
+	}
+	return snapshots, nil
+}
+
+// 同样长度的零字节覆盖，过期时间不变
+func (this *redisConnect) overwrite(id string) error {
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	size, err := redis.Int(conn.Do("STRLEN", this.key(id)))
+	if _, ok := err.(redis.Error); ok {
+		//字段存储的会话不是字符串，直接删除
+		return nil
+	}
+	if err != nil || size == 0 {
+		return err
+	}
+	_, err = conn.Do("SETRANGE", this.key(id), 0, make([]byte, size))
+	return err
+}
@@ -0,0 +1,105 @@
+package session_redis
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+func TestSoftDeleteRestore(t *testing.T) {
+	conn, server := testConnect(t, Map{"soft_delete": time.Hour, "index": true})
+
+	if err := conn.Write("a", []byte("1"), time.Hour); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Bind("user", "a"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if err := conn.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if server.Exists("a") || !server.Exists(conn.trashKey("a")) {
+		t.Fatalf("session not moved to trash")
+	}
+	if sessions, _ := conn.Sessions("user"); len(sessions) != 0 {
+		t.Fatalf("trashed session still listed: %v", sessions)
+	}
+
+	restored, err := conn.Restore("a")
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if !restored {
+		t.Fatalf("session not restored")
+	}
+	if data := testRead(t, conn, "a"); string(data) != "1" {
+		t.Fatalf("unexpected data %q", data)
+	}
+	if sessions, _ := conn.Sessions("user"); len(sessions) != 1 {
+		t.Fatalf("restored session not bound: %v", sessions)
+	}
+}
+
+func TestErasePurgesTrash(t *testing.T) {
+	conn, server := testConnect(t, Map{"soft_delete": time.Hour, "index": true})
+
+	for _, id := range []string{"a", "b"} {
+		if err := conn.Write(id, []byte("1"), time.Hour); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := conn.Bind("user", id); err != nil {
+			t.Fatalf("bind: %v", err)
+		}
+	}
+	if err := conn.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	receipt, err := conn.Erase("user", false)
+	if err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+	if len(receipt.Sessions) != 2 {
+		t.Fatalf("receipt misses sessions: %v", receipt.Sessions)
+	}
+	for _, id := range []string{"a", "b"} {
+		if server.Exists(id) || server.Exists(conn.trashKey(id)) {
+			t.Fatalf("session %s or its trash copy survived erase", id)
+		}
+	}
+
+	//Erase 之后不能再恢复
+	if restored, err := conn.Restore("a"); err != nil || restored {
+		t.Fatalf("erased session restored: %v %v", restored, err)
+	}
+	if sessions, _ := conn.Sessions("user"); len(sessions) != 0 {
+		t.Fatalf("erased user rebound: %v", sessions)
+	}
+}
+
+func TestRestoreAfterEraseRefused(t *testing.T) {
+	conn, server := testConnect(t, Map{"soft_delete": time.Hour, "index": true})
+
+	if err := conn.Write("a", []byte("1"), time.Hour); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Bind("user", "a"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+	if err := conn.Delete("a"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := conn.Erase("user", false); err != nil {
+		t.Fatalf("erase: %v", err)
+	}
+
+	//Erase 之前已经转储、之后又冒出来的回收键，比如从备份恢复的，也不能再关联回去
+	server.HSet(conn.trashKey("a"), "user", "user", "at", "1")
+	if restored, err := conn.Restore("a"); err != nil || restored {
+		t.Fatalf("trash older than erase restored: %v %v", restored, err)
+	}
+	if server.Exists(conn.trashKey("a")) {
+		t.Fatalf("stale trash key kept")
+	}
+}
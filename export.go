@@ -0,0 +1,122 @@
+package session_redis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// ExportRecord 导出的一行，NDJSON 格式，一个会话一行
+	ExportRecord struct {
+		ID       string `json:"id"`
+		TTL      int64  `json:"ttl"`      //导出时的剩余毫秒数，0表示不过期
+		Encoding string `json:"encoding"` //导出实例的存储编码，raw 或 base64
+		Size     int    `json:"size"`     //存储的字节数
+		Value    []byte `json:"value"`    //存储的原始信封，压缩、加密保持原样
+		Data     []byte `json:"data,omitempty"`
+	}
+)
+
+// 把前缀下的会话按 NDJSON 写到 w，用于备份、审计和离线分析，返回导出的个数
+// decoded 为 true 时同时写出解码后的会话数据，注意加密过的会话会以明文导出
+func (this *redisConnect) Export(prefix string, w io.Writer, decoded bool) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+
+	encoder := json.NewEncoder(w)
+	count := int64(0)
+
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			for _, group := range this.slots(keys) {
+				for _, batch := range chunks(group, this.setting.ReadBatch) {
+					records, err := this.exportBatch(conn, batch, decoded)
+					if err != nil {
+						return err
+					}
+					for _, record := range records {
+						if err := encoder.Encode(record); err != nil {
+							return err
+						}
+						count++
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		this.failed("export", prefix, err)
+		return count, err
+	}
+
+	return count, nil
+}
+
+// 一批键的剩余时间和内容，跳过不是会话的键、已经不存在的键、墓碑和字段存储的会话
+func (this *redisConnect) exportBatch(conn redis.Conn, keys []string, decoded bool) ([]ExportRecord, error) {
+	ids, found := []string{}, []string{}
+	for _, key := range keys {
+		if id, ok := this.id(key); ok {
+			ids = append(ids, id)
+			found = append(found, key)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ids = this.originals(conn, ids)
+	for _, key := range found {
+		conn.Send("PTTL", key)
+		conn.Send("GET", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	records := make([]ExportRecord, 0, len(ids))
+	for _, id := range ids {
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+		value, err := redis.String(conn.Receive())
+		if err == redis.ErrNil || ttl == -2 {
+			continue
+		}
+		//字段存储的会话不是字符串，跳过
+		if _, ok := err.(redis.Error); ok {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value == this.tombstone() {
+			continue
+		}
+
+		record := ExportRecord{ID: id, Encoding: this.setting.Encoding, Size: len(value)}
+		if ttl > 0 {
+			record.TTL = ttl
+		}
+		if this.setting.Encoding == encodingRaw {
+			record.Value = []byte(value)
+		} else if record.Value, err = base64.StdEncoding.DecodeString(value); err != nil {
+			this.failed("export", id, err)
+			continue
+		}
+		if decoded {
+			if record.Data, err = this.decode(id, value); err != nil {
+				this.failed("export", id, err)
+				continue
+			}
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
@@ -0,0 +1,91 @@
+package session_redis
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// 紧急清理，比如泄露之后让所有人重新登录，只删除本实例前缀下的会话，从不 FLUSHDB
+// 先取一个确认令牌，再带着令牌调用 FlushInstance，令牌只能用一次，过期作废
+const (
+	flushTokenTTL = time.Minute
+)
+
+var (
+	errFlushToken  = errors.New("Invalid session flush token.")
+	errFlushPrefix = errors.New("Session instance has no prefix, refused to flush.")
+)
+
+type (
+	redisFlush struct {
+		mutex   sync.Mutex
+		token   string
+		expires time.Time
+	}
+)
+
+// 生成确认令牌，一分钟内有效，重新生成后旧令牌作废
+func (this *redisConnect) FlushToken() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	this.flushing.mutex.Lock()
+	this.flushing.token = token
+	this.flushing.expires = time.Now().Add(flushTokenTTL)
+	this.flushing.mutex.Unlock()
+
+	return token, nil
+}
+
+// 清理本实例前缀下的全部会话，返回删除的键数，清理前后都记审计日志
+// 实例没有配置前缀时拒绝执行，避免把同一个库里别的应用的数据一起删掉
+func (this *redisConnect) FlushInstance(token string) (int64, error) {
+	if !this.flushConfirm(token) {
+		this.warning("session.redis.flush", "rejected")
+		return 0, errFlushToken
+	}
+
+	prefix := this.instance.Config.Prefix
+	if prefix == "" {
+		return 0, errFlushPrefix
+	}
+
+	this.warning("session.redis.flush", "start", prefix)
+	this.metric("flush", 1)
+
+	deleted := int64(0)
+	err := this.ClearProgress(prefix, func(progress Progress) error {
+		deleted = progress.Deleted
+		return nil
+	})
+	if err != nil {
+		this.warning("session.redis.flush", "failed", prefix, deleted, err)
+		return deleted, err
+	}
+
+	this.warning("session.redis.flush", "done", prefix, deleted)
+	return deleted, nil
+}
+
+// 校验并作废令牌
+func (this *redisConnect) flushConfirm(token string) bool {
+	this.flushing.mutex.Lock()
+	defer this.flushing.mutex.Unlock()
+
+	expected := this.flushing.token
+	if expected == "" || token == "" || time.Now().After(this.flushing.expires) {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return false
+	}
+	this.flushing.token = ""
+	return true
+}
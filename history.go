@@ -0,0 +1,74 @@
+package session_redis
+
+import (
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 会话历史，开启 history 时每次写入前把旧值推进一个定长列表，只保留最近 N 个版本
+// 给技术支持排查问题用，看出问题之前会话是什么样子，历史列表保留 history_ttl，每次写入续期
+var (
+	errHistoryDisabled = errors.New("Session history disabled.")
+)
+
+// 推入旧值，墓碑和非字符串的值不记录，ARGV[1] 保留个数，ARGV[2] 保留时长毫秒，ARGV[3] 墓碑
+var historyScript = redis.NewScript(2, `
+if redis.call('TYPE', KEYS[1]).ok ~= 'string' then
+	return 0
+end
+local old = redis.call('GET', KEYS[1])
+if old == ARGV[3] then
+	return 0
+end
+redis.call('LPUSH', KEYS[2], old)
+redis.call('LTRIM', KEYS[2], 0, tonumber(ARGV[1]) - 1)
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// 历史列表的键
+func (this *redisConnect) historyKey(id string) string {
+	return this.sideKey(this.setting.HistoryPrefix, id)
+}
+
+// 写入前记录旧值，失败只记日志，不影响写入
+func (this *redisConnect) record(conn redis.Conn, id string) {
+	_, err := historyScript.Do(
+		conn, this.key(id), this.historyKey(id),
+		this.setting.History, this.setting.HistoryTTL.Milliseconds(), this.tombstone(),
+	)
+	if err != nil {
+		this.failed("history", id, err)
+	}
+}
+
+// 会话的历史版本，最新的在前，不包含当前值
+func (this *redisConnect) History(id string) ([][]byte, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	if this.setting.History <= 0 {
+		return nil, errHistoryDisabled
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("LRANGE", this.historyKey(id), 0, -1))
+	if err != nil {
+		this.failed("history", id, err)
+		return nil, err
+	}
+
+	versions := make([][]byte, 0, len(values))
+	for _, value := range values {
+		data, err := this.decode(id, value)
+		if err != nil {
+			this.failed("history", id, err)
+			continue
+		}
+		versions = append(versions, data)
+	}
+	return versions, nil
+}
@@ -0,0 +1,97 @@
+package session_redis
+
+import (
+	. "github.com/infrago/base"
+)
+
+type (
+	// ErrorHandler 驱动出错时的回调，op 为操作名，key 为会话ID或者键，无法对应到键时为空
+	ErrorHandler func(op string, key string, err error)
+
+	// Validator 写入前的校验，可以拒绝，也可以返回改写后的数据，比如去掉不该放进会话的密码字段
+	Validator func(id string, data []byte) ([]byte, error)
+)
+
+// 解析 error 配置，可以直接在配置里挂一个回调
+func parseErrorHandler(setting Map) []ErrorHandler {
+	switch vv := setting["error"].(type) {
+	case ErrorHandler:
+		return []ErrorHandler{vv}
+	case func(string, string, error):
+		return []ErrorHandler{vv}
+	}
+	return nil
+}
+
+// 解析 validator 配置
+func parseValidator(setting Map) []Validator {
+	switch vv := setting["validator"].(type) {
+	case Validator:
+		return []Validator{vv}
+	case func(string, []byte) ([]byte, error):
+		return []Validator{vv}
+	}
+	return nil
+}
+
+// OnError 注册出错回调，方便接入自己的告警，比如 sentry，不用再去抓日志
+func (this *redisConnect) OnError(fn func(op string, key string, err error)) {
+	if fn == nil {
+		return
+	}
+	this.mutex.Lock()
+	this.handlers = append(this.handlers, fn)
+	this.mutex.Unlock()
+}
+
+// 记录出错，写日志并通知回调，回调里的 panic 不影响驱动
+func (this *redisConnect) failed(op, key string, err error) {
+	this.warning("session.redis."+op, err)
+
+	this.mutex.RLock()
+	handlers := this.handlers
+	this.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		func() {
+			defer func() {
+				recover()
+			}()
+			handler(op, key, err)
+		}()
+	}
+}
+
+// OnValidate 注册写入前的校验，按注册顺序执行，前一个的输出是后一个的输入
+func (this *redisConnect) OnValidate(fn func(id string, data []byte) ([]byte, error)) {
+	if fn == nil {
+		return
+	}
+	this.mutex.Lock()
+	this.validators = append(this.validators, fn)
+	this.mutex.Unlock()
+}
+
+// 执行写入前的校验
+func (this *redisConnect) validate(id string, data []byte) ([]byte, error) {
+	this.mutex.RLock()
+	validators := this.validators
+	this.mutex.RUnlock()
+
+	for _, validator := range validators {
+		out, err := validator(id, data)
+		if err != nil {
+			this.metric("validate.rejected", 1)
+			return nil, err
+		}
+		data = out
+	}
+	return data, nil
+}
+
+// 是否注册了写入前的校验
+func (this *redisConnect) validating() bool {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+	return len(this.validators) > 0
+}
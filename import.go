@@ -0,0 +1,77 @@
+package session_redis
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// 从 Export 的 NDJSON 导入，保留剩余时间和原来的信封，用于克隆环境和灾备恢复，返回导入的个数
+// 信封本实例打不开时（比如换了密钥）如果有解码后的数据，按本实例的配置重新编码
+// overwrite 为 false 时跳过已经存在的会话，检查和写入之间不是原子的
+func (this *redisConnect) Import(r io.Reader, overwrite bool) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return 0, err
+	}
+
+	decoder := json.NewDecoder(r)
+	count := int64(0)
+	for line := 1; ; line++ {
+		record := ExportRecord{}
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("Invalid session import at line %d, %v.", line, err)
+		}
+		if record.ID == "" {
+			return count, fmt.Errorf("Invalid session import at line %d, id required.", line)
+		}
+
+		imported, err := this.importRecord(record, overwrite)
+		if err != nil {
+			this.failed("import", record.ID, err)
+			return count, err
+		}
+		if imported {
+			count++
+		}
+	}
+
+	this.metric("import", count)
+	return count, nil
+}
+
+func (this *redisConnect) importRecord(record ExportRecord, overwrite bool) (bool, error) {
+	if err := this.checkKey(record.ID); err != nil {
+		return false, err
+	}
+	if !overwrite {
+		exists, err := this.exists(record.ID)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			return false, nil
+		}
+	}
+
+	value := this.encode(record.Value)
+	if _, err := this.unpack(record.ID, record.Value); err != nil {
+		if record.Data == nil {
+			return false, err
+		}
+		if value, err = this.marshal(record.ID, record.Data, false); err != nil {
+			return false, err
+		}
+	}
+
+	expire := time.Duration(record.TTL) * time.Millisecond
+	if err := this.persist(record.ID, value, expire); err != nil {
+		return false, err
+	}
+	return true, nil
+}
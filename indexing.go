@@ -0,0 +1,213 @@
+package session_redis
+
+import (
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 二级索引
+// expiry 有序集合，会话ID按过期时间排序
+// owner 哈希，会话ID到用户
+// user:<用户> 集合，用户的全部会话ID
+const (
+	indexExpiry = "expiry"
+	indexOwner  = "owner"
+	indexUser   = "user:"
+)
+
+// 开启 hash_tag 时全部索引键放在同一个槽位，事务里同时更新几个索引
+func (this *redisConnect) indexKey(name string) string {
+	if this.setting.HashTag {
+		return this.setting.IndexPrefix + "{index}" + name
+	}
+	return this.setting.IndexPrefix + name
+}
+
+// 写入会话时更新过期索引，索引键和会话键不在同一个槽位，用索引键自己的连接
+func (this *redisConnect) indexWrite(id string, expire time.Duration) {
+	var score Any = "+inf"
+	if expire > 0 {
+		score = time.Now().Add(expire).UnixNano() / int64(time.Millisecond)
+	}
+
+	conn := this.conn(this.indexKey(indexExpiry))
+	defer conn.Close()
+
+	if _, err := conn.Do("ZADD", this.indexKey(indexExpiry), score, id); err != nil {
+		this.failed("index", id, err)
+	}
+}
+
+// 删除会话时移出全部索引
+// 开启 hash_tag 时索引键在同一个槽位，用事务一起更新，否则逐个键用各自的连接
+func (this *redisConnect) indexRemove(id string) {
+	owner := this.conn(this.indexKey(indexOwner))
+	defer owner.Close()
+
+	user, err := redis.String(owner.Do("HGET", this.indexKey(indexOwner), id))
+	if err != nil && err != redis.ErrNil {
+		this.failed("index", id, err)
+		return
+	}
+
+	if this.setting.HashTag {
+		owner.Send("MULTI")
+		if user != "" {
+			owner.Send("SREM", this.indexKey(indexUser+user), id)
+		}
+		owner.Send("HDEL", this.indexKey(indexOwner), id)
+		owner.Send("ZREM", this.indexKey(indexExpiry), id)
+		if _, err := owner.Do("EXEC"); err != nil {
+			this.failed("index", id, err)
+		}
+		return
+	}
+
+	if user != "" {
+		this.indexDo("SREM", this.indexKey(indexUser+user), id)
+	}
+	this.indexDo("HDEL", this.indexKey(indexOwner), id)
+	this.indexDo("ZREM", this.indexKey(indexExpiry), id)
+}
+
+// 在索引键所在的节点上执行单个命令
+func (this *redisConnect) indexDo(command, key, id string) {
+	conn := this.conn(key)
+	defer conn.Close()
+
+	if _, err := conn.Do(command, key, id); err != nil {
+		this.failed("index", id, err)
+	}
+}
+
+// 会话关联到用户，一个会话只属于一个用户
+func (this *redisConnect) Bind(user, id string) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+	if !this.setting.Index {
+		return errIndexDisabled
+	}
+
+	conn := this.conn(this.indexKey(indexOwner))
+	defer conn.Close()
+
+	old, err := redis.String(conn.Do("HGET", this.indexKey(indexOwner), id))
+	if err != nil && err != redis.ErrNil {
+		this.failed("bind", id, err)
+		return err
+	}
+
+	conn.Send("MULTI")
+	if old != "" && old != user {
+		conn.Send("SREM", this.indexKey(indexUser+old), id)
+	}
+	conn.Send("HSET", this.indexKey(indexOwner), id, user)
+	conn.Send("SADD", this.indexKey(indexUser+user), id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		this.failed("bind", id, err)
+		return err
+	}
+
+	return nil
+}
+
+// 用户的全部会话ID
+func (this *redisConnect) Sessions(user string) ([]string, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	if !this.setting.Index {
+		return nil, errIndexDisabled
+	}
+
+	conn := this.conn(this.indexKey(indexUser + user))
+	defer conn.Close()
+
+	ids, err := redis.Strings(conn.Do("SMEMBERS", this.indexKey(indexUser+user)))
+	if err != nil {
+		this.failed("sessions", user, err)
+		return nil, err
+	}
+	return ids, nil
+}
+
+// 索引垃圾回收，移除会话键已经不存在的索引成员，防止索引无限增长
+func (this *redisConnect) indexCollect() {
+	if this.client == nil {
+		return
+	}
+
+	conn := this.conn(this.indexKey(indexExpiry))
+	defer conn.Close()
+
+	//已过期的
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	expired, err := redis.Strings(conn.Do("ZRANGEBYSCORE", this.indexKey(indexExpiry), "-inf", now))
+	if err != nil {
+		this.failed("index", "", err)
+		return
+	}
+	this.indexPrune(expired)
+
+	//有归属用户的
+	cursor := "0"
+	for {
+		vals, err := redis.Values(conn.Do("HSCAN", this.indexKey(indexOwner), cursor, "COUNT", this.setting.ScanCount))
+		if err != nil || len(vals) < 2 {
+			if err != nil {
+				this.failed("index", "", err)
+			}
+			return
+		}
+
+		cursor, _ = redis.String(vals[0], nil)
+		pairs, _ := redis.Strings(vals[1], nil)
+
+		ids := []string{}
+		for i := 0; i+1 < len(pairs); i += 2 {
+			ids = append(ids, pairs[i])
+		}
+		this.indexPrune(ids)
+
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// 移除会话键已不存在的索引成员，会话键分散在各个节点上，按槽位分组执行
+func (this *redisConnect) indexPrune(ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+
+	keys, index := this.batchKeys(ids)
+	missing := []string{}
+	err := this.pipeline(keys, false, func(key string) (string, []Any) {
+		return "EXISTS", []Any{key}
+	}, func(key string, reply Any, err error) error {
+		exists, err := redis.Int(reply, err)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			missing = append(missing, index[key])
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("index", "", err)
+		return
+	}
+
+	for _, id := range missing {
+		this.indexRemove(id)
+	}
+}
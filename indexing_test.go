@@ -0,0 +1,55 @@
+package session_redis
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+func TestIndexRemove(t *testing.T) {
+	for _, tagged := range []bool{false, true} {
+		conn, server := testConnect(t, Map{"index": true, "hash_tag": tagged})
+
+		if err := conn.Write("a", []byte("1"), time.Hour); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if err := conn.Bind("user", "a"); err != nil {
+			t.Fatalf("bind: %v", err)
+		}
+		if sessions, _ := conn.Sessions("user"); len(sessions) != 1 {
+			t.Fatalf("hash_tag %v: session not bound: %v", tagged, sessions)
+		}
+
+		if err := conn.Delete("a"); err != nil {
+			t.Fatalf("delete: %v", err)
+		}
+		if sessions, _ := conn.Sessions("user"); len(sessions) != 0 {
+			t.Fatalf("hash_tag %v: deleted session still listed: %v", tagged, sessions)
+		}
+		if server.Exists(conn.indexKey(indexUser + "user")) {
+			t.Fatalf("hash_tag %v: user set not removed", tagged)
+		}
+		if owner := server.HGet(conn.indexKey(indexOwner), "a"); owner != "" {
+			t.Fatalf("hash_tag %v: owner not removed", tagged)
+		}
+	}
+}
+
+func TestIndexPrune(t *testing.T) {
+	conn, server := testConnect(t, Map{"index": true})
+
+	if err := conn.Write("a", []byte("1"), time.Hour); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Bind("user", "a"); err != nil {
+		t.Fatalf("bind: %v", err)
+	}
+
+	//会话自己过期以后，索引按 EXISTS 的结果清理
+	server.Del("a")
+	conn.indexPrune([]string{"a"})
+	if sessions, _ := conn.Sessions("user"); len(sessions) != 0 {
+		t.Fatalf("expired session still listed: %v", sessions)
+	}
+}
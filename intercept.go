@@ -0,0 +1,74 @@
+package session_redis
+
+import (
+	. "github.com/infrago/base"
+)
+
+type (
+	// Interceptor 包装每一个会话操作，op 为操作名，key 为会话ID或前缀，批量操作为空
+	// 调用 next 执行操作本身，返回操作的错误，可以在前后做计时、追踪、路由、故障注入等
+	// 不调用 next 直接返回错误就是拦截
+	Interceptor func(op string, key string, next func() error) error
+)
+
+// 解析 interceptor 配置，可以是单个也可以是列表
+func parseInterceptors(setting Map) []Interceptor {
+	interceptors := []Interceptor{}
+	add := func(value Any) {
+		switch vv := value.(type) {
+		case Interceptor:
+			interceptors = append(interceptors, vv)
+		case func(string, string, func() error) error:
+			interceptors = append(interceptors, vv)
+		}
+	}
+
+	switch vv := setting["interceptor"].(type) {
+	case []Interceptor:
+		interceptors = append(interceptors, vv...)
+	case []Any:
+		for _, item := range vv {
+			add(item)
+		}
+	default:
+		add(vv)
+	}
+	return interceptors
+}
+
+// Use 追加拦截器，先注册的在最外层
+func (this *redisConnect) Use(interceptors ...Interceptor) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, interceptor := range interceptors {
+		if interceptor != nil {
+			this.interceptors = append(this.interceptors, interceptor)
+		}
+	}
+}
+
+// 经过拦截器链执行操作，超长的ID在这里统一拒绝
+func (this *redisConnect) intercept(op, key string, fn func() error) error {
+	if err := this.checkKey(key); err != nil {
+		return err
+	}
+	if writeOps[op] {
+		if err := this.writable(); err != nil {
+			return err
+		}
+	}
+
+	this.mutex.RLock()
+	interceptors := this.interceptors
+	this.mutex.RUnlock()
+
+	next := fn
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, inner := interceptors[i], next
+		next = func() error {
+			return interceptor(op, key, inner)
+		}
+	}
+	return next()
+}
@@ -0,0 +1,98 @@
+package session_redis
+
+import (
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 遍历前缀下的全部会话，SCAN 分批取键，再按 read_batch 分批 MGET，不在客户端攒全部数据
+// fn 返回错误时停止遍历，遍历过程中写入或删除的会话可能遍历到也可能遍历不到
+func (this *redisConnect) Iterate(prefix string, fn func(id string, data []byte) error) error {
+	return this.intercept("iterate", prefix, func() error {
+		return this.iterate(prefix, fn, nil)
+	})
+}
+
+func (this *redisConnect) iterate(prefix string, fn func(id string, data []byte) error, progress *redisProgress) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+
+	return this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			for _, group := range this.slots(keys) {
+				for _, batch := range chunks(group, this.setting.ReadBatch) {
+					visited, err := this.iterateBatch(conn, batch, fn)
+					if err != nil {
+						return err
+					}
+					if err := progress.report(int64(len(batch)), 0, visited); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+	})
+}
+
+// 一批键 MGET，跳过不是会话的键、已经不存在的键和墓碑，返回交给 fn 的会话数
+func (this *redisConnect) iterateBatch(conn redis.Conn, keys []string, fn func(id string, data []byte) error) (int64, error) {
+	ids := make([]string, 0, len(keys))
+	args := make([]Any, 0, len(keys))
+	for _, key := range keys {
+		if id, ok := this.id(key); ok {
+			ids = append(ids, id)
+			args = append(args, key)
+		}
+	}
+	if len(args) == 0 {
+		return 0, nil
+	}
+	ids = this.originals(conn, ids)
+
+	values, err := redis.Values(conn.Do("MGET", args...))
+	if err != nil {
+		this.failed("iterate", "", err)
+		return 0, err
+	}
+
+	visited := int64(0)
+	for i, value := range values {
+		if value == nil || i >= len(ids) {
+			continue
+		}
+		text, err := redis.String(value, nil)
+		if err != nil || text == this.tombstone() {
+			continue
+		}
+		data, err := this.decode(ids[i], text)
+		if err != nil {
+			this.failed("iterate", ids[i], err)
+			continue
+		}
+		visited++
+		if err := fn(ids[i], data); err != nil {
+			return visited, err
+		}
+	}
+	return visited, nil
+}
+
+// 按大小切分
+func chunks(keys []string, size int) [][]string {
+	if size <= 0 || len(keys) <= size {
+		return [][]string{keys}
+	}
+	out := make([][]string, 0, (len(keys)+size-1)/size)
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+		out = append(out, keys[start:end])
+	}
+	return out
+}
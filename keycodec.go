@@ -0,0 +1,101 @@
+package session_redis
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// 会话ID编码后再作为键，ID里有分隔符、空格、通配符或者二进制数据时不会破坏匹配模式和 Clear 的范围
+// 开启多租户时只编码租户分隔符之后的部分，租户名保持原样
+// 开启编码后前缀按字面匹配，不再支持 glob 通配符
+const (
+	keyBase64 = "base64" //URL 安全的 base64，不带填充
+	keyHex    = "hex"
+)
+
+var keyCodec = base64.RawURLEncoding
+
+// 编码会话ID
+func (this *redisConnect) encodeID(id string) string {
+	if this.setting.KeyEncoding == "" {
+		return id
+	}
+	head, rest := this.splitID(id)
+	if this.setting.KeyEncoding == keyHex {
+		return head + hex.EncodeToString([]byte(rest))
+	}
+	return head + keyCodec.EncodeToString([]byte(rest))
+}
+
+// 解码会话ID，不是编码过的键返回 false
+func (this *redisConnect) decodeID(id string) (string, bool) {
+	if this.setting.KeyEncoding == "" {
+		return id, true
+	}
+	head, rest := this.splitID(id)
+
+	var raw []byte
+	var err error
+	if this.setting.KeyEncoding == keyHex {
+		raw, err = hex.DecodeString(rest)
+	} else {
+		raw, err = keyCodec.DecodeString(rest)
+	}
+	if err != nil {
+		return "", false
+	}
+	return head + string(raw), true
+}
+
+// 拆出不编码的租户部分
+func (this *redisConnect) splitID(id string) (string, string) {
+	if tenant := this.tenant(id); tenant != "" {
+		size := len(tenant) + len(this.setting.TenantSeparator)
+		return id[:size], id[size:]
+	}
+	return "", id
+}
+
+// 编码后的前缀匹配模式
+// hex 逐字节对应，前缀编码后仍然是前缀；base64 每3个字节一组，只取整组的部分匹配，结果再用 inside 过滤
+func (this *redisConnect) encodedPattern(prefix string) string {
+	if this.setting.Tenant && this.tenant(prefix) == "" {
+		//还不到租户分隔符，只匹配租户名
+		if this.setting.HashTag && prefix != "" {
+			return this.setting.TenantPrefix + "{" + prefix + "*"
+		}
+		return this.setting.TenantPrefix + prefix + "*"
+	}
+
+	head, rest := this.splitID(prefix)
+	if this.setting.KeyEncoding == keyHex {
+		rest = hex.EncodeToString([]byte(rest))
+	} else {
+		aligned := len(rest) - len(rest)%3
+		rest = keyCodec.EncodeToString([]byte(rest[:aligned]))
+	}
+	return this.storeKey(head+rest) + "*"
+}
+
+// 会话ID是否在前缀范围内，base64 编码时匹配模式比前缀宽，要再过滤一次
+func (this *redisConnect) inside(id, prefix string) bool {
+	if this.setting.KeyEncoding != keyBase64 {
+		return true
+	}
+	return strings.HasPrefix(id, prefix)
+}
+
+// 过滤出前缀范围内的存储键
+func (this *redisConnect) within(keys []string, prefix string) []string {
+	if this.setting.KeyEncoding != keyBase64 {
+		return keys
+	}
+	out := keys[:0]
+	for _, key := range keys {
+		if id, ok := this.id(key); ok && this.inside(id, prefix) {
+			out = append(out, key)
+		}
+	}
+	return out
+}
@@ -0,0 +1,135 @@
+package session_redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	ErrKeysTruncated = errors.New("Session keys truncated.")
+)
+
+type (
+	// TruncatedError 键数超过上限，结果只有前 Limit 个
+	TruncatedError struct {
+		Limit int
+	}
+)
+
+func (err *TruncatedError) Error() string {
+	return fmt.Sprintf("Session keys truncated at %d.", err.Limit)
+}
+
+// 使 errors.Is(err, ErrKeysTruncated) 成立
+func (err *TruncatedError) Is(target error) bool {
+	return target == ErrKeysTruncated
+}
+
+// 最多返回 limit 个会话ID，同时受 max_keys 硬上限约束，limit 小于等于0时只按硬上限
+// 超出时返回已取到的ID和 *TruncatedError，前缀写得太宽也不会把几百万个键都拉到内存里
+func (this *redisConnect) KeysLimit(prefix string, limit int) (ids []string, err error) {
+	err = this.intercept("keys", prefix, func() error {
+		ids, err = this.keysLimited(prefix, this.keysCap(limit))
+		return err
+	})
+	return ids, err
+}
+
+// 实际生效的上限
+func (this *redisConnect) keysCap(limit int) int {
+	if this.setting.MaxKeys > 0 && (limit <= 0 || limit > this.setting.MaxKeys) {
+		return this.setting.MaxKeys
+	}
+	return limit
+}
+
+// 有上限时用 SCAN 取键，凑够上限再多看到一个就停止，不用 KEYS 一次性返回全部
+func (this *redisConnect) keysLimited(prefix string, limit int) ([]string, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	if limit <= 0 {
+		return this.keys(prefix)
+	}
+
+	ids := []string{}
+	truncated := false
+
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			found := []string{}
+			for _, key := range keys {
+				if id, ok := this.id(key); ok && this.inside(id, prefix) {
+					if len(ids)+len(found) >= limit {
+						truncated = true
+						break
+					}
+					found = append(found, id)
+				}
+			}
+			ids = append(ids, this.originals(conn, found)...)
+			if truncated {
+				return errStopped
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopped {
+		return nil, err
+	}
+
+	if truncated {
+		return ids, &TruncatedError{Limit: limit}
+	}
+	return ids, nil
+}
+
+// 流式返回会话ID，SCAN 一批送一批，消费方处理不过来时扫描跟着等待
+// 结束后两个通道都会关闭，出错或 ctx 取消时错误通道先收到一个错误
+// 消费期间会占用一个连接，不再读取时要取消 ctx
+func (this *redisConnect) KeysChan(ctx context.Context, prefix string) (<-chan string, <-chan error) {
+	ids := make(chan string)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(ids)
+		defer close(errs)
+
+		err := this.intercept("keys", prefix, func() error {
+			return this.keysStream(ctx, prefix, ids)
+		})
+		if err != nil {
+			errs <- err
+		}
+	}()
+
+	return ids, errs
+}
+
+func (this *redisConnect) keysStream(ctx context.Context, prefix string, ids chan<- string) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+
+	return this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			found := []string{}
+			for _, key := range keys {
+				if id, ok := this.id(key); ok && this.inside(id, prefix) {
+					found = append(found, id)
+				}
+			}
+			for _, id := range this.originals(conn, found) {
+				select {
+				case ids <- id:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return ctx.Err()
+		})
+	})
+}
@@ -0,0 +1,185 @@
+package session_redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+// Kubernetes 服务发现，定时读取 Service 的 EndpointSlice，当前地址不再就绪时切换到其它就绪的 Pod
+// 适合不用 Sentinel、由 Operator 管理 Redis 的集群，只支持集群内运行，使用 Pod 的 ServiceAccount
+const (
+	kubernetesAccount = "/var/run/secrets/kubernetes.io/serviceaccount/"
+)
+
+var (
+	errNoKubernetesEndpoint = errors.New("No ready kubernetes endpoint.")
+)
+
+type (
+	redisKubernetes struct {
+		Namespace string
+		Service   string
+		Port      string //端口名或端口号，为空时取第一个端口
+		Interval  time.Duration
+
+		client *http.Client
+		host   string
+	}
+
+	endpointSliceList struct {
+		Items []struct {
+			Endpoints []struct {
+				Addresses  []string `json:"addresses"`
+				Conditions struct {
+					Ready *bool `json:"ready"`
+				} `json:"conditions"`
+			} `json:"endpoints"`
+			Ports []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"items"`
+	}
+)
+
+// 解析配置，kubernetes = { service, namespace, port, interval }
+func parseKubernetes(setting Map) (*redisKubernetes, error) {
+	config, ok := setting["kubernetes"].(Map)
+	if !ok {
+		return nil, nil
+	}
+
+	kube := &redisKubernetes{Interval: time.Second * 30}
+	if vv, ok := config["service"].(string); ok {
+		kube.Service = vv
+	}
+	if vv, ok := config["namespace"].(string); ok {
+		kube.Namespace = vv
+	}
+	switch vv := config["port"].(type) {
+	case string:
+		kube.Port = vv
+	case int64:
+		kube.Port = strconv.FormatInt(vv, 10)
+	}
+	if vv, ok := parseDuration(config["interval"]); ok {
+		kube.Interval = vv
+	}
+
+	if kube.Service == "" {
+		return nil, errors.New("Invalid session kubernetes setting, service required.")
+	}
+	if kube.Namespace == "" {
+		if data, err := ioutil.ReadFile(kubernetesAccount + "namespace"); err == nil {
+			kube.Namespace = strings.TrimSpace(string(data))
+		} else {
+			kube.Namespace = "default"
+		}
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("Invalid session kubernetes setting, not running in cluster.")
+	}
+	kube.host = "https://" + net.JoinHostPort(host, port)
+
+	pool := x509.NewCertPool()
+	if ca, err := ioutil.ReadFile(kubernetesAccount + "ca.crt"); err == nil {
+		pool.AppendCertsFromPEM(ca)
+	}
+	kube.client = &http.Client{
+		Timeout:   time.Second * 10,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+	}
+
+	return kube, nil
+}
+
+// 取就绪的地址列表
+func (kube *redisKubernetes) endpoints() ([]string, error) {
+	query := url.Values{}
+	query.Set("labelSelector", "kubernetes.io/service-name="+kube.Service)
+	path := fmt.Sprintf("%s/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices?%s", kube.host, kube.Namespace, query.Encode())
+
+	req, err := http.NewRequest("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	//令牌会被定期轮换，每次都重新读
+	if token, err := ioutil.ReadFile(kubernetesAccount + "token"); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	res, err := kube.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Kubernetes endpointslices: %s", res.Status)
+	}
+
+	list := endpointSliceList{}
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	for _, item := range list.Items {
+		port := 0
+		for _, pp := range item.Ports {
+			if kube.Port == "" || pp.Name == kube.Port || strconv.Itoa(pp.Port) == kube.Port {
+				port = pp.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, endpoint := range item.Endpoints {
+			//没有 ready 字段按就绪处理
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, addr := range endpoint.Addresses {
+				addrs = append(addrs, net.JoinHostPort(addr, strconv.Itoa(port)))
+			}
+		}
+	}
+
+	return addrs, nil
+}
+
+// 发现一次，当前地址还就绪就不切换，避免连接来回重建
+func (this *redisConnect) discoverKubernetes() error {
+	addrs, err := this.kubernetes.endpoints()
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return errNoKubernetesEndpoint
+	}
+
+	current := this.server()
+	for _, addr := range addrs {
+		if addr == current {
+			return nil
+		}
+	}
+
+	this.switchServer(addrs[0])
+	return nil
+}
@@ -0,0 +1,86 @@
+package session_redis
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// 借出未归还的连接
+	redisLeaks struct {
+		mutex    sync.Mutex
+		next     uint64
+		borrowed map[uint64]*redisBorrow
+	}
+	redisBorrow struct {
+		at       time.Time
+		stack    []byte //调试模式下记录借出时的调用栈
+		reported bool
+	}
+	// 登记过的连接，归还时注销
+	leakConn struct {
+		redis.Conn
+		connect *redisConnect
+		id      uint64
+		once    sync.Once
+	}
+)
+
+func (c *leakConn) Close() error {
+	c.once.Do(func() {
+		c.connect.leaks.mutex.Lock()
+		delete(c.connect.leaks.borrowed, c.id)
+		c.connect.leaks.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
+
+// 登记借出的连接，开启泄漏检测时才登记
+func (this *redisConnect) track(conn redis.Conn) redis.Conn {
+	if this.setting.LeakThreshold <= 0 {
+		return conn
+	}
+
+	borrow := &redisBorrow{at: time.Now()}
+	if this.setting.Debug {
+		borrow.stack = debug.Stack()
+	}
+
+	this.leaks.mutex.Lock()
+	if this.leaks.borrowed == nil {
+		this.leaks.borrowed = map[uint64]*redisBorrow{}
+	}
+	this.leaks.next++
+	id := this.leaks.next
+	this.leaks.borrowed[id] = borrow
+	this.leaks.mutex.Unlock()
+
+	return &leakConn{Conn: conn, connect: this, id: id}
+}
+
+// 检查持有超过阈值的连接，每个连接只报一次
+func (this *redisConnect) leaking() {
+	now := time.Now()
+	leaked := []*redisBorrow{}
+
+	this.leaks.mutex.Lock()
+	for _, borrow := range this.leaks.borrowed {
+		if !borrow.reported && now.Sub(borrow.at) >= this.setting.LeakThreshold {
+			borrow.reported = true
+			leaked = append(leaked, borrow)
+		}
+	}
+	this.leaks.mutex.Unlock()
+
+	for _, borrow := range leaked {
+		this.metric("pool.leak", 1)
+		if borrow.stack != nil {
+			this.warning("session.redis.leak", now.Sub(borrow.at), string(borrow.stack))
+		} else {
+			this.warning("session.redis.leak", now.Sub(borrow.at))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package session_redis
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	oversizeReject   = "reject"
+	oversizeCompress = "compress"
+	oversizeAllow    = "allow"
+)
+
+var (
+	ErrValueTooLarge = errors.New("Session value too large.")
+)
+
+type (
+	// SizeError 会话数据超出大小限制
+	SizeError struct {
+		ID    string
+		Size  int64
+		Limit int64
+	}
+)
+
+func (err *SizeError) Error() string {
+	return fmt.Sprintf("Session %s value too large, %d bytes exceeds %d.", err.ID, err.Size, err.Limit)
+}
+
+// 使 errors.Is(err, ErrValueTooLarge) 成立
+func (err *SizeError) Is(target error) bool {
+	return target == ErrValueTooLarge
+}
+
+// 检查编码后的会话大小，按策略返回最终要写入的值
+// 超限都会计数，方便先用 allow 观察一段时间再改为 reject
+func (this *redisConnect) limit(id string, data []byte, value string) (string, error) {
+	if this.setting.MaxSize <= 0 {
+		return value, nil
+	}
+
+	size := int64(len(value))
+	if size <= this.setting.MaxSize {
+		return value, nil
+	}
+
+	this.metric("oversize", 1)
+	this.metric("oversize."+this.setting.Oversize, 1)
+
+	switch this.setting.Oversize {
+	case oversizeAllow:
+		this.warning("session.redis.oversize", id, size, this.setting.MaxSize)
+		return value, nil
+	case oversizeCompress:
+		compressed, err := this.marshal(id, data, true)
+		if err != nil {
+			return "", err
+		}
+		value = compressed
+		if size = int64(len(value)); size <= this.setting.MaxSize {
+			return value, nil
+		}
+	}
+
+	return "", &SizeError{ID: id, Size: size, Limit: this.setting.MaxSize}
+}
@@ -0,0 +1,77 @@
+package session_redis
+
+import (
+	"fmt"
+
+	. "github.com/infrago/base"
+	"github.com/infrago/log"
+)
+
+type (
+	// Logger 实例级别的日志，多应用共用一个进程时可以按实例分流驱动日志
+	Logger interface {
+		Warning(args ...Any)
+	}
+
+	// LoggerFunc 用函数作为 Logger
+	LoggerFunc func(args ...Any)
+)
+
+func (fn LoggerFunc) Warning(args ...Any) {
+	fn(args...)
+}
+
+// 解析日志配置，logger 为 Logger 或者 func(...Any)，log 为 false 时关闭驱动日志
+func parseLogger(setting Map) (Logger, bool) {
+	if vv, ok := setting["log"].(bool); ok && !vv {
+		return nil, false
+	}
+
+	switch vv := setting["logger"].(type) {
+	case Logger:
+		return vv, true
+	case func(...Any):
+		return LoggerFunc(vv), true
+	}
+	return nil, true
+}
+
+// 记录警告，没有配置实例日志时用全局日志
+// 第一个参数之后带上实例名和服务器地址，多实例部署时能分清是哪个后端
+func (this *redisConnect) warning(args ...Any) {
+	if this.quiet {
+		return
+	}
+	if len(args) > 0 {
+		args = append([]Any{args[0], this.label()}, args[1:]...)
+	}
+	if this.logger != nil {
+		this.logger.Warning(args...)
+		return
+	}
+	log.Warning(args...)
+}
+
+// 日志和指标的标签
+func (this *redisConnect) Labels() Map {
+	labels, _ := this.labels.Load().(Map)
+	if labels == nil {
+		return Map{}
+	}
+	return Map{"instance": labels["instance"], "server": labels["server"]}
+}
+
+// 服务器地址变化时更新标签
+func (this *redisConnect) relabel(server string) {
+	name := ""
+	if this.instance != nil {
+		name = this.instance.Name
+	}
+	this.labels.Store(Map{"instance": name, "server": server, "text": fmt.Sprintf("instance=%s server=%s", name, server)})
+}
+
+func (this *redisConnect) label() string {
+	labels, _ := this.labels.Load().(Map)
+	text, _ := labels["text"].(string)
+	return text
+}
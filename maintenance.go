@@ -0,0 +1,170 @@
+package session_redis
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// 维护窗口，短时间的计划内迁移期间 Write、Delete 先在内存里排队，结束后按顺序重放
+// 同一个会话只保留最后一次操作，读取优先返回排队中的数据，队列有上限，满了返回 ErrQueueFull
+// 重放时扣掉排队的时长，已经过期的写入改为删除，租户配额在重放时才检查，失败走 OnError
+// 其它写操作不排队，照常直接访问服务器，不能接受的话用只读模式
+var (
+	ErrQueueFull = errors.New("Session maintenance queue full.")
+)
+
+type (
+	redisMaintenance struct {
+		mutex     sync.Mutex
+		active    bool
+		ending    bool   //正在重放
+		replaying string //正在重放的会话
+		order     []string
+		pending   map[string]*queuedWrite
+	}
+	queuedWrite struct {
+		data    []byte
+		value   string
+		expire  time.Duration
+		deleted bool
+		purge   bool //真正删除，不走软删除
+		at      time.Time
+	}
+)
+
+// 开始维护窗口
+func (this *redisConnect) BeginMaintenance() {
+	this.maintenance.mutex.Lock()
+	defer this.maintenance.mutex.Unlock()
+
+	if this.maintenance.active {
+		return
+	}
+	this.maintenance.active = true
+	this.maintenance.order = []string{}
+	this.maintenance.pending = map[string]*queuedWrite{}
+	this.warning("session.redis.maintenance", "begin")
+}
+
+// 结束维护窗口并重放排队的写入，返回重放的个数和第一个错误
+// 重放期间队列保持生效，新的写入照常排队，读取照常返回排队的数据，队列全部重放完才真正结束
+// 重放失败的写入不会重新排队
+func (this *redisConnect) EndMaintenance() (int, error) {
+	this.maintenance.mutex.Lock()
+	if !this.maintenance.active || this.maintenance.ending {
+		this.maintenance.mutex.Unlock()
+		return 0, nil
+	}
+	this.maintenance.ending = true
+	this.maintenance.mutex.Unlock()
+
+	var first error
+	replayed, total := 0, 0
+	for {
+		this.maintenance.mutex.Lock()
+		if len(this.maintenance.order) == 0 {
+			this.maintenance.active = false
+			this.maintenance.ending = false
+			this.maintenance.replaying = ""
+			this.maintenance.order = nil
+			this.maintenance.pending = nil
+			this.maintenance.mutex.Unlock()
+			break
+		}
+		id := this.maintenance.order[0]
+		this.maintenance.order = this.maintenance.order[1:]
+		write := this.maintenance.pending[id]
+		if write == nil {
+			this.maintenance.mutex.Unlock()
+			continue
+		}
+		this.maintenance.replaying = id
+		this.maintenance.mutex.Unlock()
+
+		total++
+		err := this.replay(id, write)
+
+		//重放期间同一个会话又有新的写入时保留，等它排到再重放
+		this.maintenance.mutex.Lock()
+		if this.maintenance.pending[id] == write {
+			delete(this.maintenance.pending, id)
+		}
+		this.maintenance.replaying = ""
+		this.maintenance.mutex.Unlock()
+
+		if err != nil {
+			this.failed("maintenance", id, err)
+			if first == nil {
+				first = err
+			}
+			continue
+		}
+		replayed++
+	}
+
+	this.metric("maintenance.replayed", int64(replayed))
+	this.warning("session.redis.maintenance", "end", replayed, total)
+	return replayed, first
+}
+
+// 重放一个排队的写入，扣掉排队的时长
+func (this *redisConnect) replay(id string, write *queuedWrite) error {
+	remain := write.expire
+	if remain > 0 {
+		remain -= time.Since(write.at)
+	}
+
+	if write.deleted && write.purge {
+		return this.dropNow(id, false)
+	}
+	if write.deleted || (write.expire > 0 && remain <= 0) {
+		return this.dropNow(id, this.setting.SoftDelete > 0)
+	}
+	return this.persist(id, write.value, remain)
+}
+
+// 是否在维护窗口中
+func (this *redisConnect) Maintaining() bool {
+	this.maintenance.mutex.Lock()
+	defer this.maintenance.mutex.Unlock()
+	return this.maintenance.active
+}
+
+// 排队，不在维护窗口时返回 false
+func (this *redisConnect) enqueue(id string, write *queuedWrite) (bool, error) {
+	this.maintenance.mutex.Lock()
+	defer this.maintenance.mutex.Unlock()
+
+	if !this.maintenance.active {
+		return false, nil
+	}
+	//正在重放的会话再写入要重新排到队尾
+	if _, ok := this.maintenance.pending[id]; !ok || this.maintenance.replaying == id {
+		if len(this.maintenance.order) >= this.setting.MaintenanceQueue {
+			this.metric("maintenance.full", 1)
+			return true, ErrQueueFull
+		}
+		this.maintenance.order = append(this.maintenance.order, id)
+		if this.maintenance.replaying == id {
+			this.maintenance.replaying = ""
+		}
+	}
+	write.at = time.Now()
+	this.maintenance.pending[id] = write
+	return true, nil
+}
+
+// 排队中的数据，第二个返回值表示有排队，排队的是删除时数据为 nil
+func (this *redisConnect) queued(id string) ([]byte, bool) {
+	this.maintenance.mutex.Lock()
+	defer this.maintenance.mutex.Unlock()
+
+	if !this.maintenance.active {
+		return nil, false
+	}
+	if write, ok := this.maintenance.pending[id]; ok {
+		return write.data, true
+	}
+	return nil, false
+}
@@ -0,0 +1,93 @@
+package session_redis
+
+import (
+	"testing"
+)
+
+func TestMaintenanceQueuesWrites(t *testing.T) {
+	conn, server := testConnect(t, nil)
+
+	if err := conn.Write("gone", []byte("1"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	conn.BeginMaintenance()
+	if err := conn.Write("a", []byte("1"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := conn.Delete("gone"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if server.Exists("a") || !server.Exists("gone") {
+		t.Fatalf("writes during maintenance reached the server")
+	}
+	if data := testRead(t, conn, "a"); string(data) != "1" {
+		t.Fatalf("queued write not visible: %q", data)
+	}
+	if data := testRead(t, conn, "gone"); data != nil {
+		t.Fatalf("queued delete not visible: %q", data)
+	}
+
+	replayed, err := conn.EndMaintenance()
+	if err != nil {
+		t.Fatalf("end maintenance: %v", err)
+	}
+	if replayed != 2 {
+		t.Fatalf("expected 2 replayed writes, got %d", replayed)
+	}
+	if !server.Exists("a") || server.Exists("gone") {
+		t.Fatalf("queued writes not replayed")
+	}
+	if conn.Maintaining() {
+		t.Fatalf("maintenance still active")
+	}
+}
+
+func TestMaintenanceReadTouchSeesQueue(t *testing.T) {
+	conn, _ := testConnect(t, nil)
+
+	if err := conn.Write("a", []byte("old"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.BeginMaintenance()
+	defer conn.EndMaintenance()
+
+	if err := conn.Write("a", []byte("new"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	data, err := conn.ReadTouch("a", 60e9)
+	if err != nil {
+		t.Fatalf("read touch: %v", err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("read touch returned %q instead of the queued write", data)
+	}
+}
+
+func TestMaintenanceUpdateQueues(t *testing.T) {
+	conn, server := testConnect(t, nil)
+
+	if err := conn.Write("a", []byte("1"), 0); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	conn.BeginMaintenance()
+
+	update := func(old []byte) ([]byte, error) {
+		return append(old, '+'), nil
+	}
+	for i := 0; i < 2; i++ {
+		if err := conn.Update("a", update); err != nil {
+			t.Fatalf("update: %v", err)
+		}
+	}
+	if value, _ := server.Get("a"); value != conn.encode([]byte("1")) {
+		t.Fatalf("update during maintenance reached the server")
+	}
+
+	if _, err := conn.EndMaintenance(); err != nil {
+		t.Fatalf("end maintenance: %v", err)
+	}
+	if data := testRead(t, conn, "a"); string(data) != "1++" {
+		t.Fatalf("unexpected data %q", data)
+	}
+}
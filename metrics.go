@@ -0,0 +1,41 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+type (
+	redisMetrics struct {
+		mutex    sync.Mutex
+		counters map[string]int64
+
+		exhausted int64     //上次连接池耗尽告警的时间
+		opened    time.Time //计数开始的时间，用来算速率
+	}
+)
+
+// 计数
+func (this *redisConnect) metric(name string, delta int64) {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+
+	if this.metrics.counters == nil {
+		this.metrics.counters = map[string]int64{}
+	}
+	this.metrics.counters[name] += delta
+}
+
+// 当前的计数快照
+func (this *redisConnect) Metrics() Map {
+	this.metrics.mutex.Lock()
+	defer this.metrics.mutex.Unlock()
+
+	metrics := Map{}
+	for name, value := range this.metrics.counters {
+		metrics[name] = value
+	}
+	return metrics
+}
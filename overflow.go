@@ -0,0 +1,88 @@
+package session_redis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 超长的会话ID，调用方用不受控的用户输入拼ID时，避免巨大的键拖慢服务器
+// hash 策略把超长的部分换成 SHA-256，原始ID记在元数据哈希里，Keys 返回时换回原始ID
+// reject 策略直接拒绝
+const (
+	overflowHash   = "hash"
+	overflowReject = "reject"
+
+	hashedMarker = "~sha256:"
+)
+
+var (
+	ErrKeyTooLong = errors.New("Session key too long.")
+)
+
+// 超长的ID换成哈希，租户部分保留
+func (this *redisConnect) overflow(id, encoded string) string {
+	if this.setting.MaxKeyLength <= 0 || len(encoded) <= this.setting.MaxKeyLength {
+		return encoded
+	}
+	head, rest := this.splitID(id)
+	sum := sha256.Sum256([]byte(rest))
+	return head + hashedMarker + hex.EncodeToString(sum[:])
+}
+
+// 是否是超长被哈希的ID
+func (this *redisConnect) hashed(id string) bool {
+	return this.setting.MaxKeyLength > 0 && len(this.encodeID(id)) > this.setting.MaxKeyLength
+}
+
+// reject 策略下检查ID长度
+func (this *redisConnect) checkKey(id string) error {
+	if this.setting.KeyOverflow == overflowReject && this.hashed(id) {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+// 元数据哈希，哈希后的存储键到原始ID
+func (this *redisConnect) keyMeta() string {
+	return this.setting.IndexPrefix + "keymeta"
+}
+
+// 写入时记录原始ID
+func (this *redisConnect) keyRemember(conn redis.Conn, id string) {
+	if !this.hashed(id) {
+		return
+	}
+	if _, err := conn.Do("HSET", this.keyMeta(), this.key(id), id); err != nil {
+		this.failed("keymeta", id, err)
+	}
+}
+
+// 删除时移除原始ID
+func (this *redisConnect) keyForget(conn redis.Conn, id string) {
+	if !this.hashed(id) {
+		return
+	}
+	if _, err := conn.Do("HDEL", this.keyMeta(), this.key(id)); err != nil {
+		this.failed("keymeta", id, err)
+	}
+}
+
+// 把哈希过的ID换回原始ID，查不到的保持哈希形式
+func (this *redisConnect) originals(conn redis.Conn, ids []string) []string {
+	if this.setting.MaxKeyLength <= 0 {
+		return ids
+	}
+	for i, id := range ids {
+		if !strings.Contains(id, hashedMarker) {
+			continue
+		}
+		if original, err := redis.String(conn.Do("HGET", this.keyMeta(), this.storeKey(id))); err == nil {
+			ids[i] = original
+		}
+	}
+	return ids
+}
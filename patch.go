@@ -0,0 +1,222 @@
+package session_redis
+
+import (
+	"encoding/json"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 按字段存储的会话，哈希结构，每个字段单独编码
+// 不同的请求同时修改不同的字段时互不覆盖，这类会话只能用 Patch 和 ReadFields 读写
+// 和 Write 一样过校验器、大小限制和租户配额，校验器看到的是 {字段: 值} 的修改文档，大小按全部字段编码后的总和算
+var patchScript = redis.NewScript(2, `
+local expire = tonumber(ARGV[1])
+local count = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local quota = tonumber(ARGV[4])
+local now = tonumber(ARGV[5])
+local start = 7
+if KEYS[2] ~= '' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+	if redis.call('EXISTS', KEYS[1]) == 0 and quota > 0 and redis.call('ZCARD', KEYS[2]) >= quota then
+		return {0, 0}
+	end
+end
+if limit > 0 then
+	local sizes = {}
+	local fields = redis.call('HGETALL', KEYS[1])
+	for j = 1, #fields, 2 do
+		sizes[fields[j]] = #fields[j + 1]
+	end
+	local i = start
+	for j = 1, count do
+		sizes[ARGV[i]] = #ARGV[i + 1]
+		i = i + 2
+	end
+	while i <= #ARGV do
+		sizes[ARGV[i]] = nil
+		i = i + 1
+	end
+	local total = 0
+	for _, size in pairs(sizes) do
+		total = total + size
+	end
+	if total > limit then
+		return {-1, total}
+	end
+end
+local i = start
+for j = 1, count do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+	i = i + 2
+end
+while i <= #ARGV do
+	redis.call('HDEL', KEYS[1], ARGV[i])
+	i = i + 1
+end
+if expire > 0 and redis.call('EXISTS', KEYS[1]) == 1 then
+	redis.call('PEXPIRE', KEYS[1], expire)
+end
+local size = redis.call('HLEN', KEYS[1])
+if KEYS[2] ~= '' then
+	if size == 0 then
+		redis.call('ZREM', KEYS[2], ARGV[6])
+	else
+		local ttl = redis.call('PTTL', KEYS[1])
+		if ttl > 0 then
+			redis.call('ZADD', KEYS[2], now + ttl, ARGV[6])
+		else
+			redis.call('ZADD', KEYS[2], '+inf', ARGV[6])
+		end
+	end
+end
+return {1, size}
+`)
+
+// 在服务器上合并字段修改，set 里的字段覆盖写入，remove 里的字段删除
+// expire 为0时保持原来的过期时间，字段全部删除后会话也就不存在了
+func (this *redisConnect) Patch(id string, set Map, remove []string, expire time.Duration) error {
+	return this.intercept("patch", id, func() error {
+		return this.patch(id, set, remove, expire)
+	})
+}
+
+func (this *redisConnect) patch(id string, set Map, remove []string, expire time.Duration) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+	if len(set) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	//超出大小时 allow 只记录，其他策略在脚本里按总大小拒绝
+	limit := this.setting.MaxSize
+	if this.setting.Oversize == oversizeAllow {
+		limit = 0
+	}
+	tenant, tenantKey := this.tenant(id), ""
+	if tenant != "" {
+		tenantKey = this.tenantKey(tenant)
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	//写入前校验，校验器看到的是 {字段: 值} 的修改文档，可能改写数据
+	if len(set) > 0 && this.validating() {
+		doc, err := json.Marshal(set)
+		if err != nil {
+			return err
+		}
+		if doc, err = this.validate(id, doc); err != nil {
+			return err
+		}
+		if set, err = decodeMap(doc); err != nil {
+			return err
+		}
+	}
+
+	//大小只在脚本里按全部字段的总和检查
+	args := []Any{this.key(id), tenantKey, expire.Milliseconds(), len(set), limit, this.tenantQuota(tenant), now, id}
+	for field, value := range set {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		encoded, err := this.marshal(id, data, false)
+		if err != nil {
+			return err
+		}
+		args = append(args, field, encoded)
+	}
+	for _, field := range remove {
+		args = append(args, field)
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	this.uncache(this.key(id))
+	vals, err := redis.Int64s(patchScript.Do(conn, args...))
+	if err != nil {
+		this.failed("patch", id, err)
+		return err
+	}
+	if len(vals) < 2 {
+		return errEmptyData
+	}
+	switch vals[0] {
+	case 0:
+		return &QuotaError{Tenant: tenant, Quota: this.tenantQuota(tenant)}
+	case -1:
+		this.metric("oversize", 1)
+		this.metric("oversize."+this.setting.Oversize, 1)
+		return &SizeError{ID: id, Size: vals[1], Limit: this.setting.MaxSize}
+	}
+	size := vals[1]
+
+	//二级索引
+	if this.setting.Index {
+		if size == 0 {
+			this.indexRemove(id)
+		} else if expire > 0 {
+			this.indexWrite(id, expire)
+		}
+	}
+	if size == 0 {
+		this.keyForget(conn, id)
+		this.emit(EventDelete, id, 0)
+	} else {
+		this.keyRemember(conn, id)
+		this.metric("session.write", 1)
+		this.emit(EventWrite, id, expire)
+	}
+
+	return nil
+}
+
+// 读取按字段存储的会话，不存在时返回 nil
+func (this *redisConnect) ReadFields(id string) (Map, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	conn := this.read(this.key(id))
+	defer conn.Close()
+
+	fields, err := redis.StringMap(conn.Do("HGETALL", this.key(id)))
+	if err != nil {
+		this.failed("readfields", id, err)
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, this.missing()
+	}
+
+	value := Map{}
+	for field, encoded := range fields {
+		data, err := this.decode(id, encoded)
+		if err != nil {
+			return nil, err
+		}
+		item, err := decodeField(data)
+		if err != nil {
+			return nil, err
+		}
+		value[field] = item
+	}
+	return value, nil
+}
+
+// 解码单个字段
+func decodeField(data []byte) (Any, error) {
+	wrapped, err := decodeMap(append(append([]byte(`{"v":`), data...), '}'))
+	if err != nil {
+		return nil, err
+	}
+	return wrapped["v"], nil
+}
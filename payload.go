@@ -0,0 +1,64 @@
+package session_redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+// Map 会话数据，驱动里直接按 JSON 编解码，和 Read/Write 用同一个信封，压缩、加密照常
+// 会话模块不用先序列化成 []byte 再交给驱动
+
+// 读取 Map 会话，不存在时返回 nil
+func (this *redisConnect) ReadMap(id string) (Map, error) {
+	data, err := this.Read(id)
+	if err != nil || len(data) == 0 {
+		return nil, err
+	}
+	return decodeMap(data)
+}
+
+// 写入 Map 会话
+func (this *redisConnect) WriteMap(id string, value Map, expire time.Duration) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return this.Write(id, data, expire)
+}
+
+// 解码 Map，整数还原为 int64，不会都变成 float64
+func decodeMap(data []byte) (Map, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	value := Map{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return normalize(value).(Map), nil
+}
+
+func normalize(value Any) Any {
+	switch vv := value.(type) {
+	case json.Number:
+		if n, err := vv.Int64(); err == nil {
+			return n
+		}
+		f, _ := vv.Float64()
+		return f
+	case map[string]Any:
+		for k, v := range vv {
+			vv[k] = normalize(v)
+		}
+		return vv
+	case []Any:
+		for i, v := range vv {
+			vv[i] = normalize(v)
+		}
+		return vv
+	}
+	return value
+}
@@ -0,0 +1,161 @@
+package session_redis
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 连接池耗尽时的处理
+const (
+	exhaustedFail  = "fail"  //立即返回 ErrPoolExhausted，默认
+	exhaustedWait  = "wait"  //等待空闲连接，最多等 wait_timeout，为0时一直等
+	exhaustedBurst = "burst" //临时多建连接，用完直接关闭，不回连接池
+)
+
+var (
+	// ErrPoolExhausted 连接池耗尽，和 redigo 的是同一个错误
+	ErrPoolExhausted = redis.ErrPoolExhausted
+)
+
+type (
+	// 不可用的连接，命令都返回借连接时的错误
+	failedConn struct {
+		err error
+	}
+	// 超出连接池上限临时建立的连接
+	burstConn struct {
+		redis.Conn
+		connect *redisConnect
+		closed  bool
+	}
+)
+
+func (c failedConn) Close() error                   { return nil }
+func (c failedConn) Err() error                     { return c.err }
+func (c failedConn) Do(string, ...Any) (Any, error) { return nil, c.err }
+func (c failedConn) Send(string, ...Any) error      { return c.err }
+func (c failedConn) Flush() error                   { return c.err }
+func (c failedConn) Receive() (Any, error)          { return nil, c.err }
+
+func (c *burstConn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	atomic.AddInt64(&c.connect.bursting, -1)
+	return c.Conn.Close()
+}
+
+// 借连接超过这个时长算作等待
+const poolWaitThreshold = time.Millisecond
+
+// 连接池耗尽的告警间隔，避免高峰期刷屏
+const poolWarnInterval = time.Second * 10
+
+// 从连接池借连接，记录等待和耗尽，连接池配置偏小时能提前发现
+func (this *redisConnect) borrow(pool *redis.Pool) redis.Conn {
+	start := time.Now()
+	conn := this.take(pool)
+	elapsed := time.Since(start)
+
+	this.metric("pool.borrow", 1)
+	if elapsed >= poolWaitThreshold {
+		this.metric("pool.wait", 1)
+		this.metric("pool.wait_ms", elapsed.Milliseconds())
+	}
+	if conn.Err() == redis.ErrPoolExhausted {
+		this.metric("pool.exhausted", 1)
+		this.exhausted(pool)
+		if this.setting.Exhausted == exhaustedBurst {
+			return this.track(this.burst(pool, conn))
+		}
+	}
+
+	this.trace(conn)
+	return this.track(conn)
+}
+
+// 按耗尽策略从连接池取连接
+func (this *redisConnect) take(pool *redis.Pool) redis.Conn {
+	if this.setting.Exhausted != exhaustedWait || this.setting.WaitTimeout <= 0 {
+		return pool.Get()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), this.setting.WaitTimeout)
+	defer cancel()
+
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			err = redis.ErrPoolExhausted
+		}
+		if conn != nil {
+			conn.Close()
+		}
+		return failedConn{err: err}
+	}
+	return conn
+}
+
+// 临时超出连接池上限新建连接，超过 burst 个时仍然返回耗尽
+func (this *redisConnect) burst(pool *redis.Pool, exhausted redis.Conn) redis.Conn {
+	if atomic.AddInt64(&this.bursting, 1) > int64(this.setting.Burst) {
+		atomic.AddInt64(&this.bursting, -1)
+		return exhausted
+	}
+
+	c, err := pool.Dial()
+	if err != nil {
+		atomic.AddInt64(&this.bursting, -1)
+		return failedConn{err: err}
+	}
+	exhausted.Close()
+
+	this.metric("pool.burst", 1)
+	return &burstConn{Conn: c, connect: this}
+}
+
+// 连接池耗尽告警
+func (this *redisConnect) exhausted(pool *redis.Pool) {
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&this.metrics.exhausted)
+	if now-last < int64(poolWarnInterval) || !atomic.CompareAndSwapInt64(&this.metrics.exhausted, last, now) {
+		return
+	}
+	this.warning("session.redis.pool", "exhausted", pool.ActiveCount(), this.setting.Active, this.setting.Exhausted)
+}
+
+// 连接池状态，主库以及副本、集群节点
+func (this *redisConnect) PoolStats() Map {
+	stats := Map{}
+	if this.client != nil {
+		stats["primary"] = poolStats(this.client)
+	}
+
+	this.replicas.mutex.RLock()
+	for addr, pool := range this.replicas.pools {
+		stats["replica:"+addr] = poolStats(pool)
+	}
+	this.replicas.mutex.RUnlock()
+
+	this.mutex.RLock()
+	for addr, pool := range this.nodes {
+		stats["node:"+addr] = poolStats(pool)
+	}
+	this.mutex.RUnlock()
+
+	return stats
+}
+
+func poolStats(pool *redis.Pool) Map {
+	stats := pool.Stats()
+	return Map{
+		"active": stats.ActiveCount, "idle": stats.IdleCount,
+		"wait_count": stats.WaitCount, "wait_duration": stats.WaitDuration,
+	}
+}
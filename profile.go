@@ -0,0 +1,81 @@
+package session_redis
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// 云厂商托管 Redis 的预设，先套用预设再读取显式配置，显式配置优先
+type (
+	redisProfile struct {
+		TLS      bool
+		Username string //默认的 ACL 用户名
+		Dial     time.Duration
+		Read     time.Duration
+		Disabled []string //厂商禁用的命令
+	}
+)
+
+var redisProfiles = map[string]redisProfile{
+	"elasticache": {
+		TLS: true, Dial: time.Second * 5, Read: time.Second * 3,
+		Disabled: []string{"CONFIG", "DEBUG", "MONITOR", "SAVE", "BGSAVE", "SLAVEOF", "REPLICAOF"},
+	},
+	"azure": {
+		TLS: true, Dial: time.Second * 10, Read: time.Second * 5,
+		Disabled: []string{"CONFIG", "DEBUG", "MONITOR", "SAVE", "BGSAVE", "MIGRATE", "SLAVEOF", "REPLICAOF"},
+	},
+	"upstash": {
+		TLS: true, Username: "default", Dial: time.Second * 10, Read: time.Second * 10,
+		Disabled: []string{"CONFIG", "DEBUG", "MONITOR", "SELECT", "CLIENT", "OBJECT"},
+	},
+	"memorystore": {
+		Dial: time.Second * 5, Read: time.Second * 3,
+		Disabled: []string{"CONFIG", "DEBUG", "MONITOR", "SAVE", "BGSAVE", "SLAVEOF", "REPLICAOF"},
+	},
+}
+
+// 套用预设
+func applyProfile(setting *redisSetting, name string) error {
+	profile, ok := redisProfiles[strings.ToLower(name)]
+	if !ok {
+		return fmt.Errorf("Invalid session provider %q.", name)
+	}
+
+	setting.Provider = strings.ToLower(name)
+	setting.TLS = profile.TLS
+	setting.Username = profile.Username
+	setting.DialTimeout = profile.Dial
+	setting.ReadTimeout = profile.Read
+	for _, cmd := range profile.Disabled {
+		setting.Disabled[cmd] = true
+	}
+	return nil
+}
+
+// 命令是否被禁用
+func (this *redisConnect) disabled(cmd string) bool {
+	return this.setting.Disabled[strings.ToUpper(cmd)]
+}
+
+// 检查开启的功能依赖的命令有没有被禁用
+func checkDisabled(setting redisSetting) error {
+	features := []struct {
+		on   bool
+		name string
+		cmd  string
+	}{
+		{setting.Database > 0, "database", "SELECT"},
+		{setting.Cache, "cache", "CLIENT"},
+		{setting.NoEvict, "no_evict", "CLIENT"},
+		{setting.NoTouch, "no_touch", "CLIENT"},
+		{setting.ReapIdle > 0, "reap_idle", "OBJECT"},
+	}
+	for _, feature := range features {
+		if feature.on && setting.Disabled[feature.cmd] {
+			return fmt.Errorf("Invalid session setting, %s requires %s which is disabled.", feature.name, feature.cmd)
+		}
+	}
+	return nil
+}
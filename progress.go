@@ -0,0 +1,62 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+)
+
+type (
+	// Progress 长时间运行的 Clear、Iterate 的进度
+	Progress struct {
+		Processed int64 //扫描到的键数
+		Deleted   int64 //Clear 删除的键数
+		Visited   int64 //Iterate 交给回调的会话数
+		Elapsed   time.Duration
+	}
+
+	// ProgressFunc 每处理完一批调用一次，返回错误时中途停止，错误原样返回给调用方
+	ProgressFunc func(Progress) error
+
+	redisProgress struct {
+		mutex    sync.Mutex
+		fn       ProgressFunc
+		start    time.Time
+		progress Progress
+	}
+)
+
+func newProgress(fn ProgressFunc) *redisProgress {
+	if fn == nil {
+		return nil
+	}
+	return &redisProgress{fn: fn, start: time.Now()}
+}
+
+// 累加一批的计数并回调，并行清理时多个协程同时上报，回调是串行的
+func (this *redisProgress) report(processed, deleted, visited int64) error {
+	if this == nil {
+		return nil
+	}
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	this.progress.Processed += processed
+	this.progress.Deleted += deleted
+	this.progress.Visited += visited
+	this.progress.Elapsed = time.Since(this.start)
+	return this.fn(this.progress)
+}
+
+// 带进度的 Clear，运维工具可以显示进度并随时取消
+func (this *redisConnect) ClearProgress(prefix string, progress ProgressFunc) error {
+	return this.intercept("clear", prefix, func() error {
+		return this.clear(prefix, newProgress(progress))
+	})
+}
+
+// 带进度的 Iterate
+func (this *redisConnect) IterateProgress(prefix string, fn func(id string, data []byte) error, progress ProgressFunc) error {
+	return this.intercept("iterate", prefix, func() error {
+		return this.iterate(prefix, fn, newProgress(progress))
+	})
+}
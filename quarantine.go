@@ -0,0 +1,134 @@
+package session_redis
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 隔离，开启 quarantine 时读到损坏的会话不再一直报错，取不到密钥这类临时错误原样返回，不动会话
+// 把坏掉的值连同错误信息挪到隔离键里保留 quarantine_ttl，会话按不存在处理，用户重新拿一个新会话
+// 工程师之后用 Quarantined 取出来分析
+var (
+	errQuarantineNotFound = errors.New("Session quarantine not found.")
+)
+
+// 值没被改过才挪走，避免把并发写入的新会话隔离掉
+// ARGV[1] 读到的值，ARGV[2] 错误，ARGV[3] 当前时间毫秒，ARGV[4] 保留时长毫秒
+var quarantineScript = redis.NewScript(2, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('DEL', KEYS[2])
+redis.call('HMSET', KEYS[2], 'value', ARGV[1], 'error', ARGV[2], 'at', ARGV[3], 'ttl', ttl)
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+type (
+	// QuarantineEntry 被隔离的会话
+	QuarantineEntry struct {
+		ID    string
+		Value []byte        //存储的原始值
+		Error string        //解码时的错误
+		Time  time.Time     //隔离的时间
+		TTL   time.Duration //隔离时会话的剩余时间，0表示不过期
+	}
+)
+
+// 隔离键
+func (this *redisConnect) quarantineKey(id string) string {
+	return this.sideKey(this.setting.QuarantinePrefix, id)
+}
+
+// 是否是数据本身损坏，取不到密钥、密钥服务不可用之类的错误不算，会话本身是好的
+func corrupted(err error) bool {
+	switch err.(type) {
+	case base64.CorruptInputError, flate.CorruptInputError:
+		return true
+	}
+	switch err {
+	case errInvalidEnvelope, errInvalidCiphertext, gzip.ErrHeader, gzip.ErrChecksum, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	return false
+}
+
+// 解码失败时隔离，成功隔离后按会话不存在返回，隔离不了或者不是数据损坏还是返回原来的错误
+func (this *redisConnect) quarantine(id, value string, cause error) error {
+	if !this.setting.Quarantine || this.ReadOnly() || !corrupted(cause) {
+		return cause
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	moved, err := redis.Int(quarantineScript.Do(
+		conn, this.key(id), this.quarantineKey(id),
+		value, cause.Error(), now, this.setting.QuarantineTTL.Milliseconds(),
+	))
+	if err != nil {
+		this.failed("quarantine", id, err)
+		return cause
+	}
+	if moved == 0 {
+		return cause
+	}
+
+	this.uncache(this.key(id))
+	if this.setting.Index {
+		//记下所属用户，Erase 时连隔离键一起删除
+		if user, err := this.owner(id); err == nil {
+			this.retain(user, id)
+		}
+		this.indexRemove(id)
+	}
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZREM", this.tenantKey(tenant), id); err != nil {
+			this.failed("quarantine", id, err)
+		}
+	}
+	this.keyForget(conn, id)
+
+	this.metric("session.quarantine", 1)
+	this.warning("session.redis.quarantine", id, len(value), cause)
+	this.emit(EventDelete, id, 0)
+	return this.missing()
+}
+
+// 取出被隔离的会话
+func (this *redisConnect) Quarantined(id string) (*QuarantineEntry, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	vals, err := redis.Strings(conn.Do("HMGET", this.quarantineKey(id), "value", "error", "at", "ttl"))
+	if err != nil {
+		this.failed("quarantined", id, err)
+		return nil, err
+	}
+	if len(vals) < 4 || vals[2] == "" {
+		return nil, errQuarantineNotFound
+	}
+
+	entry := &QuarantineEntry{ID: id, Value: []byte(vals[0]), Error: vals[1]}
+	if at, err := strconv.ParseInt(vals[2], 10, 64); err == nil {
+		entry.Time = time.Unix(0, at*int64(time.Millisecond))
+	}
+	if ttl, err := strconv.ParseInt(vals[3], 10, 64); err == nil && ttl > 0 {
+		entry.TTL = time.Duration(ttl) * time.Millisecond
+	}
+	return entry, nil
+}
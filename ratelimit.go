@@ -0,0 +1,84 @@
+package session_redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 滑动窗口限流，窗口内的每次请求都作为有序集合的一个成员，分值为请求时间
+var rateLimitScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+local count = redis.call('ZCARD', KEYS[1])
+if count >= limit then
+	redis.call('PEXPIRE', KEYS[1], window)
+	return {0, 0}
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return {1, limit - count - 1}
+`)
+
+// 同一毫秒内的请求用序号区分成员，加上进程的随机前缀，多个实例之间不会撞成同一个成员
+var (
+	rateLimitSequence int64
+	rateLimitNonce    = func() string {
+		buf := make([]byte, 8)
+		rand.Read(buf)
+		return hex.EncodeToString(buf)
+	}()
+)
+
+var (
+	errInvalidRateLimit  = errors.New("Invalid session rate limit.")
+	errRateLimitDisabled = errors.New("Session rate limit disabled.")
+)
+
+// 限流，返回本次是否放行，以及窗口内剩余的次数
+// 适合登录重试、会话创建等按用户或IP的节流，要开启 ratelimit
+func (this *redisConnect) RateLimit(key string, limit int64, window time.Duration) (bool, int64, error) {
+	if this.client == nil {
+		return false, 0, errInvalidCacheConnection
+	}
+	if !this.setting.RateLimit {
+		return false, 0, errRateLimitDisabled
+	}
+	if err := this.writable(); err != nil {
+		return false, 0, err
+	}
+	if limit <= 0 || window <= 0 {
+		return false, 0, errInvalidRateLimit
+	}
+
+	conn := this.conn(this.rateLimitKey(key))
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	member := fmt.Sprintf("%d-%s-%d", now, rateLimitNonce, atomic.AddInt64(&rateLimitSequence, 1))
+
+	vals, err := redis.Int64s(rateLimitScript.Do(
+		conn, this.rateLimitKey(key), now, window.Milliseconds(), limit, member,
+	))
+	if err != nil {
+		this.failed("ratelimit", key, err)
+		return false, 0, err
+	}
+	if len(vals) < 2 {
+		return false, 0, nil
+	}
+
+	return vals[0] == 1, vals[1], nil
+}
+
+// 限流键，和会话分开存放
+func (this *redisConnect) rateLimitKey(key string) string {
+	return this.setting.RateLimitPrefix + this.key(key)
+}
@@ -0,0 +1,39 @@
+package session_redis
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// 只读模式，迁移 Redis 或者临时把副本提升为只读时打开，读取照常，写入和删除返回 ErrReadOnly
+var (
+	ErrReadOnly = errors.New("Session store is read-only.")
+)
+
+// 会改数据的操作
+var writeOps = map[string]bool{
+	"write": true, "writemulti": true, "delete": true, "deletemulti": true, "clear": true,
+	"update": true, "patch": true, "readonce": true,
+}
+
+// 运行中切换只读模式
+func (this *redisConnect) SetReadOnly(on bool) {
+	value := int32(0)
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&this.readonly, value)
+}
+
+// 是否只读
+func (this *redisConnect) ReadOnly() bool {
+	return atomic.LoadInt32(&this.readonly) == 1
+}
+
+// 写入前检查
+func (this *redisConnect) writable() error {
+	if this.ReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package session_redis
+
+import (
+	"github.com/gomodule/redigo/redis"
+)
+
+// 清理空闲会话，按 OBJECT IDLETIME 判断，读写都会重置空闲时间
+// 注意 maxmemory-policy 为 LFU 时服务器不提供 IDLETIME
+func (this *redisConnect) reap() {
+	if this.client == nil {
+		return
+	}
+
+	idle := int64(this.setting.ReapIdle.Seconds())
+
+	//集群模式下每个主节点都要扫
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(this.setting.ReapPrefix), func(keys []string) error {
+			for _, key := range keys {
+				conn.Send("OBJECT", "IDLETIME", key)
+			}
+			if err := conn.Flush(); err != nil {
+				return err
+			}
+
+			idles := make([]int64, len(keys))
+			for i := range keys {
+				idles[i], _ = redis.Int64(conn.Receive())
+			}
+
+			ids := []string{}
+			for i, key := range keys {
+				if idles[i] < idle {
+					continue
+				}
+				if id, ok := this.id(key); ok {
+					ids = append(ids, id)
+				}
+			}
+			for _, id := range this.originals(conn, ids) {
+				if err := this.remove(conn, id); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		this.failed("reap", "", err)
+	}
+}
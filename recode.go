@@ -0,0 +1,125 @@
+package session_redis
+
+import (
+	"bytes"
+	"encoding/base64"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 重新编码，值没有被并发修改时才替换，保留原来的过期时间
+var recodeScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[2])
+end
+return 1
+`)
+
+// Recode 把已有的会话按当前的编码重写，比如旧的 base64 改为 raw、补上压缩和加密、换成当前密钥
+// from 是这些会话现在存储用的编码，base64 或 raw，返回重写的数量
+// 已经是当前格式的跳过，解不开的跳过并记录，写入和扫描同时进行的会话不会被覆盖
+func (this *redisConnect) Recode(prefix string, from string) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return 0, err
+	}
+	if from != encodingBase64 && from != encodingRaw {
+		from = this.setting.Encoding
+	}
+
+	count := int64(0)
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			for _, key := range keys {
+				id, ok := this.id(key)
+				if !ok {
+					continue
+				}
+				id = this.originals(conn, []string{id})[0]
+
+				old, err := redis.String(conn.Do("GET", key))
+				if err != nil || old == "" || old == this.tombstone() {
+					continue
+				}
+
+				packed, err := decodeWith(old, from)
+				if err != nil {
+					continue
+				}
+				if from == this.setting.Encoding && this.current(id, packed) {
+					continue
+				}
+
+				data, err := this.unpack(id, packed)
+				if err != nil {
+					this.metric("recode.failed", 1)
+					this.failed("recode", id, err)
+					continue
+				}
+				value, err := this.marshal(id, data, false)
+				if err != nil {
+					return err
+				}
+				if value, err = this.limit(id, data, value); err != nil {
+					this.metric("recode.failed", 1)
+					continue
+				}
+
+				replaced, err := redis.Int(recodeScript.Do(conn, key, old, value))
+				if err != nil {
+					return err
+				}
+				if replaced == 1 {
+					this.uncache(key)
+					count++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		this.failed("recode", prefix, err)
+		return count, err
+	}
+
+	this.metric("recode", count)
+	return count, nil
+}
+
+// 按指定的编码解出存储的字节
+func decodeWith(value string, encoding string) ([]byte, error) {
+	if encoding == encodingRaw {
+		return []byte(value), nil
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// 存储的字节是否已经是当前格式，开启加密时要用当前密钥加密过，按租户选密钥时是租户的当前密钥
+// 没有绑定会话ID的旧密文也要重新加密
+func (this *redisConnect) current(id string, packed []byte) bool {
+	enveloped := bytes.HasPrefix(packed, []byte(envelopeMagic)) && len(packed) > len(envelopeMagic)
+	if !this.encrypted() {
+		return !enveloped || packed[len(envelopeMagic)]&flagEncrypt == 0
+	}
+	if !enveloped || packed[len(envelopeMagic)]&(flagEncrypt|flagBound) != flagEncrypt|flagBound {
+		return false
+	}
+
+	id, _, err := this.keyring.current(this.tenant(id))
+	if err != nil {
+		return true
+	}
+	body := packed[len(envelopeMagic)+1:]
+	if len(body) < 1 || len(body) < 1+int(body[0]) {
+		return false
+	}
+	return string(body[1:1+int(body[0])]) == id
+}
@@ -0,0 +1,101 @@
+package session_redis
+
+import (
+	"strings"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// 处理集群重定向的连接
+	// 只处理 Do，管道（Send/Receive）和事务里的重定向不处理
+	redirectConn struct {
+		redis.Conn
+		connect *redisConnect
+	}
+)
+
+func (conn *redirectConn) Do(cmd string, args ...Any) (Any, error) {
+	reply, err := conn.Conn.Do(cmd, args...)
+
+	for i := 0; i < conn.connect.setting.Redirects && err != nil; i++ {
+		addr, ask, ok := parseRedirect(err)
+		if !ok {
+			break
+		}
+		//MOVED 说明槽位表过期了
+		if !ask && conn.connect.setting.Cluster {
+			conn.connect.clusterRefreshSoon()
+		}
+		reply, err = conn.connect.redirect(addr, ask, cmd, args...)
+	}
+
+	return reply, err
+}
+
+// 在指定节点上执行命令，ASK 重定向要先发 ASKING
+func (this *redisConnect) redirect(addr string, ask bool, cmd string, args ...Any) (Any, error) {
+	conn := this.borrow(this.node(addr))
+	defer conn.Close()
+
+	if ask {
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Do(cmd, args...)
+}
+
+// 节点连接池，没有就创建并缓存
+func (this *redisConnect) node(addr string) *redis.Pool {
+	this.mutex.RLock()
+	pool, ok := this.nodes[addr]
+	this.mutex.RUnlock()
+	if ok {
+		return pool
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if pool, ok := this.nodes[addr]; ok {
+		return pool
+	}
+	if this.nodes == nil {
+		this.nodes = map[string]*redis.Pool{}
+	}
+	pool = this.pool(addr)
+	this.nodes[addr] = pool
+	return pool
+}
+
+func (this *redisConnect) closeNodes() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	for _, pool := range this.nodes {
+		pool.Close()
+	}
+	this.nodes = nil
+}
+
+// 解析重定向错误，格式为 MOVED <slot> <addr> 或 ASK <slot> <addr>
+func parseRedirect(err error) (string, bool, bool) {
+	if _, ok := err.(redis.Error); !ok {
+		return "", false, false
+	}
+
+	fields := strings.Fields(err.Error())
+	if len(fields) != 3 {
+		return "", false, false
+	}
+	switch fields[0] {
+	case "MOVED":
+		return fields[2], false, true
+	case "ASK":
+		return fields[2], true, true
+	}
+	return "", false, false
+}
@@ -0,0 +1,103 @@
+package session_redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 读取时异步续期，剩余时间不足阈值才续期到 refresh_ttl，实现滑动过期，不增加读延迟
+var refreshScript = redis.NewScript(1, `
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 and ttl < tonumber(ARGV[1]) then
+	redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// 待续期队列长度，满了直接丢弃，下次读取还会再触发
+const refreshQueue = 1024
+
+type (
+	redisRefresh struct {
+		mutex   sync.Mutex
+		pending map[string]bool
+		queue   chan string
+	}
+)
+
+// 读取成功后登记续期，同一个会话排队中不重复登记
+func (this *redisConnect) refreshing(id string) {
+	if this.setting.RefreshTTL <= 0 || this.refresh.queue == nil {
+		return
+	}
+
+	this.refresh.mutex.Lock()
+	if this.refresh.pending[id] {
+		this.refresh.mutex.Unlock()
+		return
+	}
+	this.refresh.pending[id] = true
+	this.refresh.mutex.Unlock()
+
+	select {
+	case this.refresh.queue <- id:
+	default:
+		this.refresh.mutex.Lock()
+		delete(this.refresh.pending, id)
+		this.refresh.mutex.Unlock()
+		this.metric("refresh.dropped", 1)
+	}
+}
+
+// 后台续期
+func (this *redisConnect) refresher() {
+	defer this.waiter.Done()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case id := <-this.refresh.queue:
+			this.refresh.mutex.Lock()
+			delete(this.refresh.pending, id)
+			this.refresh.mutex.Unlock()
+
+			if err := this.renew(id); err != nil {
+				this.failed("refresh", id, err)
+			}
+		}
+	}
+}
+
+// 续期单个会话，租户和索引的过期时间同步更新
+func (this *redisConnect) renew(id string) error {
+	if this.ReadOnly() {
+		return nil
+	}
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	ttl := this.setting.RefreshTTL
+	renewed, err := redis.Int(refreshScript.Do(conn, this.key(id), this.setting.RefreshThreshold.Milliseconds(), ttl.Milliseconds()))
+	if err != nil || renewed == 0 {
+		return err
+	}
+	this.metric("refresh", 1)
+	this.emit(EventExpire, id, ttl)
+
+	ms := time.Now().Add(ttl).UnixNano() / int64(time.Millisecond)
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZADD", this.tenantKey(tenant), "XX", ms, id); err != nil {
+			return err
+		}
+	}
+	if this.setting.Index {
+		if _, err := conn.Do("ZADD", this.indexKey(indexExpiry), "XX", ms, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
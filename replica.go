@@ -0,0 +1,288 @@
+package session_redis
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 只读副本，Read/Exists 之类的读请求轮询分到副本上
+// 副本可以在 replicas 里静态配置，也可以由 Sentinel 发现
+type (
+	redisReplicas struct {
+		mutex sync.RWMutex
+		addrs []string
+		pools map[string]*redis.Pool
+		next  uint64
+
+		latency   map[string]time.Duration //平滑后的 PING 延迟，PING 失败的不在里面
+		preferred string                   //latency 模式下优先读的副本
+
+		weights map[string]float64 //读流量权重，primary、replicas 和副本地址
+	}
+)
+
+// 副本选择方式
+const (
+	replicaRoundRobin = "round_robin" //轮询，默认
+	replicaLatency    = "latency"     //优先延迟最低的健康副本
+)
+
+// 解析静态配置的副本，数组或逗号分隔
+func parseAddrs(value Any) []string {
+	addrs := []string{}
+	switch vv := value.(type) {
+	case string:
+		for _, addr := range strings.Split(vv, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	case []string:
+		addrs = append(addrs, vv...)
+	case []Any:
+		for _, v := range vv {
+			if addr, ok := v.(string); ok && addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// 更新副本列表，新增的建连接池，移除的关闭
+func (this *redisConnect) setReplicas(addrs []string) {
+	this.replicas.mutex.Lock()
+	defer this.replicas.mutex.Unlock()
+
+	if this.replicas.pools == nil {
+		this.replicas.pools = map[string]*redis.Pool{}
+	}
+
+	keep := map[string]bool{}
+	for _, addr := range addrs {
+		keep[addr] = true
+		if _, ok := this.replicas.pools[addr]; !ok {
+			this.replicas.pools[addr] = this.pool(addr)
+		}
+	}
+	for addr, pool := range this.replicas.pools {
+		if !keep[addr] {
+			pool.Close()
+			delete(this.replicas.pools, addr)
+		}
+	}
+
+	this.replicas.addrs = addrs
+}
+
+func (this *redisConnect) closeReplicas() {
+	this.setReplicas(nil)
+}
+
+// 取读连接，有副本时轮询副本，否则按键取主库连接
+// 开启客户端缓存时读主库，副本上的读取没有失效通知
+func (this *redisConnect) read(key string) redis.Conn {
+	if this.setting.Cache || this.setting.Cluster || this.routed(key) != nil {
+		return this.conn(key)
+	}
+
+	//锁里只选出连接池，借连接可能要等，放到锁外面
+	pool := this.replica()
+	if pool == nil {
+		return this.conn(key)
+	}
+	return &redirectConn{Conn: this.borrow(pool), connect: this}
+}
+
+// 选出读请求用的副本连接池，返回 nil 时读主库
+func (this *redisConnect) replica() *redis.Pool {
+	this.replicas.mutex.RLock()
+	defer this.replicas.mutex.RUnlock()
+
+	if len(this.replicas.addrs) == 0 {
+		return nil
+	}
+
+	//按权重分流
+	if len(this.replicas.weights) > 0 {
+		addr, primary := this.weighted()
+		if primary {
+			return nil
+		}
+		if this.setting.ReplicaSelect != replicaLatency {
+			return this.replicas.pools[addr]
+		}
+	}
+
+	if this.setting.ReplicaSelect == replicaLatency {
+		if pool, ok := this.replicas.pools[this.replicas.preferred]; ok {
+			return pool
+		}
+	}
+
+	index := atomic.AddUint64(&this.replicas.next, 1) % uint64(len(this.replicas.addrs))
+	return this.replicas.pools[this.replicas.addrs[index]]
+}
+
+// 测量副本延迟，选出最快的健康副本
+// 当前副本仍然健康时，新副本要快过 latency_margin 的比例才切换，避免来回抖动
+func (this *redisConnect) measureReplicas() {
+	this.replicas.mutex.RLock()
+	pools := map[string]*redis.Pool{}
+	for addr, pool := range this.replicas.pools {
+		pools[addr] = pool
+	}
+	this.replicas.mutex.RUnlock()
+
+	measured := map[string]time.Duration{}
+	for addr, pool := range pools {
+		conn := this.borrow(pool)
+		start := time.Now()
+		_, err := conn.Do("PING")
+		elapsed := time.Since(start)
+		conn.Close()
+
+		if err != nil {
+			this.metric("replica.unhealthy", 1)
+			this.failed("replica", "", err)
+			continue
+		}
+		measured[addr] = elapsed
+	}
+
+	this.replicas.mutex.Lock()
+	defer this.replicas.mutex.Unlock()
+
+	//指数平滑，单次的抖动不影响选择
+	latency := map[string]time.Duration{}
+	for addr, elapsed := range measured {
+		if _, ok := this.replicas.pools[addr]; !ok {
+			continue
+		}
+		if old, ok := this.replicas.latency[addr]; ok {
+			elapsed = (old*7 + elapsed*3) / 10
+		}
+		latency[addr] = elapsed
+	}
+	this.replicas.latency = latency
+
+	fastest := ""
+	for addr, elapsed := range latency {
+		if fastest == "" || elapsed < latency[fastest] {
+			fastest = addr
+		}
+	}
+
+	current, healthy := latency[this.replicas.preferred]
+	if healthy && fastest != "" {
+		threshold := time.Duration(float64(current) * (1 - this.setting.LatencyMargin))
+		if latency[fastest] >= threshold {
+			return
+		}
+	}
+	if fastest != this.replicas.preferred {
+		this.replicas.preferred = fastest
+		this.metric("replica.switch", 1)
+	}
+}
+
+// 副本的平滑延迟
+func (this *redisConnect) ReplicaLatency() Map {
+	this.replicas.mutex.RLock()
+	defer this.replicas.mutex.RUnlock()
+
+	latency := Map{}
+	for addr, elapsed := range this.replicas.latency {
+		latency[addr] = elapsed
+	}
+	return latency
+}
+
+// 解析 read_weights，比如 { primary = 20, replicas = 80 }，primary 为主库，replicas 平分给所有副本，
+// 写副本地址的单独指定，可以把读流量逐步移到副本上，确认副本健康后再全部放过去
+func parseWeights(value Any) (map[string]float64, error) {
+	config, ok := value.(Map)
+	if !ok {
+		return nil, nil
+	}
+
+	weights := map[string]float64{}
+	for name, value := range config {
+		weight := float64(-1)
+		switch vv := value.(type) {
+		case int64:
+			weight = float64(vv)
+		case int:
+			weight = float64(vv)
+		case float64:
+			weight = vv
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("Invalid session read weight %s.", name)
+		}
+		weights[name] = weight
+	}
+	return weights, nil
+}
+
+// 运行中调整读流量权重，nil 恢复为只按 replica_select 读副本
+func (this *redisConnect) SetReadWeights(weights map[string]float64) {
+	this.replicas.mutex.Lock()
+	defer this.replicas.mutex.Unlock()
+
+	this.replicas.weights = nil
+	if len(weights) > 0 {
+		this.replicas.weights = map[string]float64{}
+		for name, weight := range weights {
+			if weight >= 0 {
+				this.replicas.weights[name] = weight
+			}
+		}
+	}
+}
+
+// 按权重抽一个，返回副本地址或者主库，调用方持有副本的读锁
+func (this *redisConnect) weighted() (string, bool) {
+	weights := this.replicas.weights
+	spread := 0.0
+	if len(this.replicas.addrs) > 0 {
+		spread = weights["replicas"] / float64(len(this.replicas.addrs))
+	}
+
+	total := weights["primary"]
+	for _, addr := range this.replicas.addrs {
+		if weight, ok := weights[addr]; ok {
+			total += weight
+		} else {
+			total += spread
+		}
+	}
+	if total <= 0 {
+		return "", true
+	}
+
+	pick := rand.Float64() * total
+	if pick < weights["primary"] {
+		return "", true
+	}
+	pick -= weights["primary"]
+	for _, addr := range this.replicas.addrs {
+		weight, ok := weights[addr]
+		if !ok {
+			weight = spread
+		}
+		if pick < weight {
+			return addr, false
+		}
+		pick -= weight
+	}
+	return this.replicas.addrs[len(this.replicas.addrs)-1], false
+}
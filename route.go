@@ -0,0 +1,253 @@
+package session_redis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 路由表，一个会话实例按会话ID前缀或者租户分到多个 Redis，比如把付费租户隔离到独立的 Redis，应用不用改
+// routes = [{ prefix = "vip:", server = "10.0.0.2:6379" }, { tenant = "acme", server = "10.0.0.3:6379" }]
+// 按顺序匹配，第一个匹配的为准，都不匹配的走主服务器，路由的服务器用同样的认证和数据库
+// Clear、Keys 这些扫描操作会依次扫描主服务器和所有路由的服务器
+// 键编码、超长键哈希之后看不出前缀，集群、客户端缓存、二级索引也都假定只有一个服务器，不能一起用
+type (
+	redisRoute struct {
+		Prefix string
+		Tenant string
+		Server string
+		Region string //按地域生成的路由
+
+		pool *redis.Pool
+	}
+)
+
+// 解析 routes 配置
+func parseRoutes(setting Map) ([]*redisRoute, error) {
+	configs := []Map{}
+	switch vv := setting["routes"].(type) {
+	case []Map:
+		configs = vv
+	case []Any:
+		for _, item := range vv {
+			if config, ok := item.(Map); ok {
+				configs = append(configs, config)
+			}
+		}
+	}
+
+	routes := []*redisRoute{}
+	for i, config := range configs {
+		route := &redisRoute{}
+		if vv, ok := config["prefix"].(string); ok {
+			route.Prefix = vv
+		}
+		if vv, ok := config["tenant"].(string); ok {
+			route.Tenant = vv
+		}
+		if vv, ok := config["server"].(string); ok {
+			route.Server = vv
+		}
+		if route.Server == "" || (route.Prefix == "") == (route.Tenant == "") {
+			return nil, fmt.Errorf("Invalid session route %d, server and one of prefix or tenant required.", i)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// 数据驻留，regions 为地域到服务器的映射，tenant_regions 为租户到地域的映射，
+// 比如 regions = { eu = "eu.redis:6379" }、tenant_regions = { acme = "eu" }，欧盟租户的会话只落在欧盟的 Redis 上
+// 按租户路由生成，排在 routes 之前，和驻留租户重叠的前缀路由在 Connect 时拒绝
+func parseRegions(setting Map) ([]*redisRoute, error) {
+	regions, _ := setting["regions"].(Map)
+	tenants, _ := setting["tenant_regions"].(Map)
+	if len(tenants) == 0 {
+		return nil, nil
+	}
+
+	routes := []*redisRoute{}
+	for tenant, value := range tenants {
+		region, _ := value.(string)
+		server, _ := regions[region].(string)
+		if server == "" {
+			return nil, fmt.Errorf("Invalid session tenant region %s, region %q not found.", tenant, region)
+		}
+		routes = append(routes, &redisRoute{Tenant: tenant, Server: server, Region: region})
+	}
+	return routes, nil
+}
+
+// 会话所在的地域，没有按地域路由时返回空
+func (this *redisConnect) Region(id string) string {
+	tenant := this.tenant(id)
+	if tenant == "" {
+		return ""
+	}
+	for _, route := range this.routes {
+		if route.Tenant == tenant {
+			return route.Region
+		}
+	}
+	return ""
+}
+
+// 有路由时不能开启的功能
+func checkRoutes(routes []*redisRoute, setting redisSetting) error {
+	if len(routes) == 0 {
+		return nil
+	}
+	switch {
+	case setting.Cluster:
+		return errors.New("Invalid session setting, routes and cluster are exclusive.")
+	case setting.Cache:
+		return errors.New("Invalid session setting, routes and cache are exclusive.")
+	case setting.Index:
+		return errors.New("Invalid session setting, routes and index are exclusive.")
+	case setting.KeyEncoding != "" || setting.MaxKeyLength > 0:
+		return errors.New("Invalid session setting, routes require plain keys.")
+	}
+	for _, route := range routes {
+		if route.Tenant != "" && !setting.Tenant {
+			return errors.New("Invalid session setting, tenant routes require tenant.")
+		}
+	}
+	//驻留租户的会话不能被别的路由分走
+	for _, region := range routes {
+		if region.Region == "" {
+			continue
+		}
+		scope := region.Tenant + setting.TenantSeparator
+		for _, route := range routes {
+			if route.Region != "" {
+				continue
+			}
+			if route.Tenant == region.Tenant && route.Server != region.Server {
+				return fmt.Errorf("Invalid session route for tenant %s, tenant resides in region %s.", route.Tenant, region.Region)
+			}
+			if route.Prefix != "" && (strings.HasPrefix(route.Prefix, scope) || strings.HasPrefix(scope, route.Prefix)) {
+				return fmt.Errorf("Invalid session route prefix %q, overlaps tenant %s in region %s.", route.Prefix, region.Tenant, region.Region)
+			}
+		}
+	}
+	return nil
+}
+
+// 建立路由的连接池
+func (this *redisConnect) openRoutes() {
+	for _, route := range this.routes {
+		route.pool = this.pool(route.Server)
+	}
+}
+
+func (this *redisConnect) closeRoutes() {
+	for _, route := range this.routes {
+		if route.pool != nil {
+			route.pool.Close()
+			route.pool = nil
+		}
+	}
+}
+
+// 存储键对应的路由连接池，不匹配时返回 nil
+// 租户路由同时匹配租户的会话和计数键，配额脚本在同一个服务器上执行
+// 计数、限流、序列、回收这些附属键按里面带的会话键路由，和会话落在同一个服务器
+func (this *redisConnect) routed(key string) *redis.Pool {
+	key = this.embedded(key)
+	for _, route := range this.routes {
+		if route.Tenant != "" {
+			counter := this.tenantKey(route.Tenant)
+			if key == counter || strings.HasPrefix(key, this.storeKey(route.Tenant+this.setting.TenantSeparator)) {
+				return route.pool
+			}
+			continue
+		}
+		if strings.HasPrefix(key, this.storeKey(route.Prefix)) {
+			return route.pool
+		}
+	}
+	return nil
+}
+
+// 附属键去掉前缀和 hashtag，取出里面带的存储键
+func (this *redisConnect) embedded(key string) string {
+	//只认开启了的功能的前缀，没开启时同样前缀的键就是会话
+	prefixes := []string{}
+	if this.setting.Counter {
+		prefixes = append(prefixes, this.setting.CounterPrefix)
+	}
+	if this.setting.RateLimit {
+		prefixes = append(prefixes, this.setting.RateLimitPrefix)
+	}
+	if this.setting.Sequence {
+		prefixes = append(prefixes, this.setting.SequencePrefix)
+	}
+	if this.setting.Shard {
+		prefixes = append(prefixes, this.setting.ShardPrefix)
+	}
+	if this.setting.SoftDelete > 0 {
+		prefixes = append(prefixes, this.setting.TrashPrefix)
+	}
+	if this.setting.Snapshot {
+		prefixes = append(prefixes, this.setting.SnapshotPrefix)
+	}
+	if this.setting.History > 0 {
+		prefixes = append(prefixes, this.setting.HistoryPrefix)
+	}
+	if this.setting.Quarantine {
+		prefixes = append(prefixes, this.setting.QuarantinePrefix)
+	}
+	for _, prefix := range prefixes {
+		if prefix == "" || !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		key = key[len(prefix):]
+		if strings.HasPrefix(key, "{") {
+			if end := strings.Index(key, "}"); end == len(key)-1 {
+				key = key[1:end]
+			} else if end > 0 && key[1:end] == this.setting.SequenceTag {
+				key = key[end+1:]
+			}
+		}
+		return key
+	}
+	return key
+}
+
+// 路由的服务器，扫描时用，同一个服务器只扫一次
+func (this *redisConnect) routeServers() map[string]*redis.Pool {
+	servers := map[string]*redis.Pool{}
+	for _, route := range this.routes {
+		if route.pool != nil && route.Server != this.server() {
+			servers[route.Server] = route.pool
+		}
+	}
+	return servers
+}
+
+// 按路由分组，没有路由时只有一组
+func (this *redisConnect) routeGroups(keys []string) [][]string {
+	if len(this.routes) == 0 {
+		return [][]string{keys}
+	}
+
+	groups := map[*redis.Pool][]string{}
+	order := []*redis.Pool{}
+	for _, key := range keys {
+		pool := this.routed(key)
+		if _, ok := groups[pool]; !ok {
+			order = append(order, pool)
+		}
+		groups[pool] = append(groups[pool], key)
+	}
+
+	batches := make([][]string, 0, len(order))
+	for _, pool := range order {
+		batches = append(batches, groups[pool])
+	}
+	return batches
+}
@@ -0,0 +1,175 @@
+package session_redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// 密码和 TLS 材料可以引用 AWS 的密钥
+// arn:aws:secretsmanager:<region>:<account>:secret:<name> Secrets Manager，JSON 密钥可以加 #字段 取其中一项
+// ssm:<参数名> SSM Parameter Store，自动解密 SecureString
+// Connect 时取一次并缓存，之后定时刷新，密码变化时重建连接
+const (
+	secretsManagerPrefix = "arn:aws:secretsmanager:"
+	ssmPrefix            = "ssm:"
+)
+
+type (
+	redisSecrets struct {
+		refs     map[string]string //配置项到引用
+		region   string
+		interval time.Duration
+	}
+)
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, secretsManagerPrefix) || strings.HasPrefix(value, ssmPrefix)
+}
+
+// 找出引用了密钥的配置项
+func parseSecrets(setting Map) *redisSecrets {
+	secrets := &redisSecrets{refs: map[string]string{}, interval: time.Minute * 5}
+	for _, name := range []string{"username", "password", "tls_ca", "tls_cert", "tls_key"} {
+		if vv, ok := setting[name].(string); ok && isSecretRef(vv) {
+			secrets.refs[name] = vv
+		}
+	}
+	if len(secrets.refs) == 0 {
+		return nil
+	}
+
+	if vv, ok := setting["aws_region"].(string); ok && vv != "" {
+		secrets.region = vv
+	}
+	if vv, ok := parseDuration(setting["secret_refresh"]); ok {
+		secrets.interval = vv
+	}
+	return secrets
+}
+
+// 取一个引用的值
+func (secrets *redisSecrets) fetch(ctx context.Context, ref string) (string, error) {
+	region := secrets.region
+	field := ""
+	if strings.HasPrefix(ref, secretsManagerPrefix) {
+		if pos := strings.Index(ref, "#"); pos > 0 {
+			ref, field = ref[:pos], ref[pos+1:]
+		}
+		//ARN 里带了区域
+		if parts := strings.Split(ref, ":"); len(parts) > 3 && parts[3] != "" {
+			region = parts[3]
+		}
+	}
+
+	opts := []func(*config.LoadOptions) error{}
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(ref, ssmPrefix) {
+		out, err := ssm.NewFromConfig(cfg).GetParameter(ctx, &ssm.GetParameterInput{
+			Name: aws.String(strings.TrimPrefix(ref, ssmPrefix)), WithDecryption: aws.Bool(true),
+		})
+		if err != nil {
+			return "", err
+		}
+		if out.Parameter == nil {
+			return "", fmt.Errorf("Empty ssm parameter %s.", ref)
+		}
+		return aws.ToString(out.Parameter.Value), nil
+	}
+
+	out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(ref),
+	})
+	if err != nil {
+		return "", err
+	}
+	value := aws.ToString(out.SecretString)
+	if value == "" && out.SecretBinary != nil {
+		value = string(out.SecretBinary)
+	}
+
+	if field != "" {
+		fields := map[string]Any{}
+		if err := json.Unmarshal([]byte(value), &fields); err != nil {
+			return "", err
+		}
+		vv, ok := fields[field].(string)
+		if !ok {
+			return "", fmt.Errorf("Missing field %s in secret %s.", field, ref)
+		}
+		value = vv
+	}
+
+	return value, nil
+}
+
+// 取全部引用，写入配置，返回是否有变化
+func (this *redisConnect) resolveSecrets() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	values := map[string]string{}
+	for name, ref := range this.secrets.refs {
+		value, err := this.secrets.fetch(ctx, ref)
+		if err != nil {
+			return false, err
+		}
+		values[name] = value
+	}
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	changed := false
+	for name, value := range values {
+		var field *string
+		switch name {
+		case "username":
+			field = &this.setting.Username
+		case "password":
+			field = &this.setting.Password
+		case "tls_ca":
+			field = &this.setting.TLSCA
+		case "tls_cert":
+			field = &this.setting.TLSCert
+		case "tls_key":
+			field = &this.setting.TLSKey
+		default:
+			continue
+		}
+		if *field != value {
+			*field = value
+			changed = true
+		}
+	}
+
+	return changed, nil
+}
+
+// 定时刷新
+func (this *redisConnect) refreshSecrets() {
+	changed, err := this.resolveSecrets()
+	if err != nil {
+		this.failed("secret", "", err)
+		return
+	}
+	if changed {
+		this.rebuild()
+	}
+}
@@ -0,0 +1,159 @@
+package session_redis
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Sentinel 模式，从哨兵取主库地址，同时取副本地址用于读请求
+// 订阅哨兵的事件，主库切换、副本上下线时重新发现
+var (
+	errNoSentinel = errors.New("No available sentinel.")
+)
+
+var sentinelEvents = []interface{}{"+switch-master", "+slave", "+sdown", "-sdown", "+odown", "-odown"}
+
+// 连接一个哨兵
+func (this *redisConnect) dialSentinel(addr string) (redis.Conn, error) {
+	options := []redis.DialOption{redis.DialConnectTimeout(time.Second * 3)}
+	if this.setting.SentinelPassword != "" {
+		options = append(options, redis.DialPassword(this.setting.SentinelPassword))
+	}
+	return redis.Dial("tcp", addr, options...)
+}
+
+// 依次询问哨兵，第一个能回答的为准
+func (this *redisConnect) discoverSentinel() error {
+	var lastErr error = errNoSentinel
+
+	for _, addr := range this.setting.Sentinels {
+		conn, err := this.dialSentinel(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		master, replicas, err := this.querySentinel(conn)
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		this.switchServer(master)
+		if this.setting.SentinelReplicas {
+			this.setReplicas(replicas)
+		}
+		return nil
+	}
+
+	return lastErr
+}
+
+func (this *redisConnect) querySentinel(conn redis.Conn) (string, []string, error) {
+	vals, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", this.setting.SentinelMaster))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(vals) < 2 {
+		return "", nil, errNoSentinel
+	}
+	master := net.JoinHostPort(vals[0], vals[1])
+
+	if !this.setting.SentinelReplicas {
+		return master, nil, nil
+	}
+
+	//老版本只有 SENTINEL slaves
+	reply, err := redis.Values(conn.Do("SENTINEL", "replicas", this.setting.SentinelMaster))
+	if err != nil && isUnknownCommand(err) {
+		reply, err = redis.Values(conn.Do("SENTINEL", "slaves", this.setting.SentinelMaster))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	replicas := []string{}
+	for _, item := range reply {
+		fields, err := redis.StringMap(item, nil)
+		if err != nil {
+			continue
+		}
+		flags := fields["flags"]
+		if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") || strings.Contains(flags, "disconnected") {
+			continue
+		}
+		if fields["ip"] == "" || fields["port"] == "" {
+			continue
+		}
+		replicas = append(replicas, net.JoinHostPort(fields["ip"], fields["port"]))
+	}
+
+	return master, replicas, nil
+}
+
+// 订阅哨兵事件，断开后换下一个哨兵继续
+func (this *redisConnect) watchSentinel() {
+	defer this.waiter.Done()
+
+	for i := 0; ; i++ {
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+
+		addr := this.setting.Sentinels[i%len(this.setting.Sentinels)]
+		if err := this.subscribeSentinel(addr); err != nil {
+			this.failed("sentinel", "", err)
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (this *redisConnect) subscribeSentinel(addr string) error {
+	conn, err := this.dialSentinel(addr)
+	if err != nil {
+		return err
+	}
+
+	//Close 时关掉订阅连接，让 Receive 返回
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-this.done:
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(sentinelEvents...); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			//事件只关心自己的主库，内容里带有主库名
+			if !strings.Contains(string(v.Data), this.setting.SentinelMaster) {
+				continue
+			}
+			if err := this.discoverSentinel(); err != nil {
+				this.failed("sentinel", "", err)
+			}
+		case error:
+			return v
+		}
+	}
+}
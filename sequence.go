@@ -0,0 +1,150 @@
+package session_redis
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 序列，不存在时初始化为起始值，存在时按步长增加，同时设置过期时间，整个过程在一个脚本里原子执行
+// 多进程同时取号也不会重复
+// 设置了最大值时，超出后回绕到起始值，或者返回溢出错误，回绕用 INCRBY 实现以保留过期时间
+var sequenceScript = redis.NewScript(1, `
+local start = tonumber(ARGV[1])
+local step = tonumber(ARGV[2])
+local max = tonumber(ARGV[4])
+local value
+local current = redis.call('GET', KEYS[1])
+if current then
+	current = tonumber(current)
+	if max > 0 and current + step > max then
+		if ARGV[5] ~= '1' then
+			return redis.error_reply('SEQUENCE_OVERFLOW')
+		end
+		value = redis.call('INCRBY', KEYS[1], start - current)
+	else
+		value = redis.call('INCRBY', KEYS[1], step)
+	end
+else
+	redis.call('SET', KEYS[1], start)
+	value = start
+end
+local expire = tonumber(ARGV[3])
+if expire > 0 then
+	redis.call('PEXPIRE', KEYS[1], expire)
+end
+return value
+`)
+
+var (
+	ErrSequenceOverflow = errors.New("Session sequence overflow.")
+
+	errSequenceDisabled = errors.New("Session sequence disabled.")
+)
+
+// 取序列的下一个值，第一次取到的是 start，要开启 sequence
+func (this *redisConnect) Sequence(key string, start, step int64, expire time.Duration) (int64, error) {
+	return this.SequenceLimit(key, start, step, 0, false, expire)
+}
+
+// 取有上限的序列，比如6位的一次性验证码，max为0不限制
+// 超出 max 时 rollover 为 true 回绕到 start，否则返回 ErrSequenceOverflow
+func (this *redisConnect) SequenceLimit(key string, start, step, max int64, rollover bool, expire time.Duration) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+	if !this.setting.Sequence {
+		return 0, errSequenceDisabled
+	}
+	if err := this.writable(); err != nil {
+		return 0, err
+	}
+
+	conn := this.conn(this.sequenceKey(key))
+	defer conn.Close()
+
+	wrap := 0
+	if rollover {
+		wrap = 1
+	}
+
+	value, err := redis.Int64(sequenceScript.Do(conn, this.sequenceKey(key), start, step, expire.Milliseconds(), max, wrap))
+	if err != nil {
+		if rerr, ok := err.(redis.Error); ok && strings.Contains(rerr.Error(), "SEQUENCE_OVERFLOW") {
+			return 0, ErrSequenceOverflow
+		}
+		this.failed("sequence", key, err)
+		return 0, err
+	}
+	return value, nil
+}
+
+// 重置序列，保留原来的过期时间
+var sequenceResetScript = redis.NewScript(1, `
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('SET', KEYS[1], ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+end
+return 1
+`)
+
+// 把序列重置为指定值，下一次 Sequence 取到的是 value+step
+func (this *redisConnect) SequenceReset(key string, value int64) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if !this.setting.Sequence {
+		return errSequenceDisabled
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+
+	conn := this.conn(this.sequenceKey(key))
+	defer conn.Close()
+
+	if _, err := sequenceResetScript.Do(conn, this.sequenceKey(key), value); err != nil {
+		this.failed("sequence", key, err)
+		return err
+	}
+	return nil
+}
+
+// 读取序列当前值，不增加，序列不存在时返回 false
+func (this *redisConnect) SequencePeek(key string) (int64, bool, error) {
+	if this.client == nil {
+		return 0, false, errInvalidCacheConnection
+	}
+	if !this.setting.Sequence {
+		return 0, false, errSequenceDisabled
+	}
+
+	conn := this.conn(this.sequenceKey(key))
+	defer conn.Close()
+
+	value, err := redis.Int64(conn.Do("GET", this.sequenceKey(key)))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+	if err != nil {
+		this.failed("sequence", key, err)
+		return 0, false, err
+	}
+	return value, true, nil
+}
+
+// 序列的存储键，放在 sequence_prefix 下，开启 hash_tag 时整个键作为 hashtag，配置了 sequence_tag 时共用一个
+// 脚本只操作这一个键，集群里总是单槽位
+func (this *redisConnect) sequenceKey(key string) string {
+	prefix := this.setting.SequencePrefix
+	if this.setting.SequenceTag != "" {
+		return prefix + "{" + this.setting.SequenceTag + "}" + this.key(key)
+	}
+	if this.setting.HashTag && !strings.Contains(key, "{") {
+		return prefix + "{" + this.key(key) + "}"
+	}
+	return prefix + this.key(key)
+}
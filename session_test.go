@@ -0,0 +1,44 @@
+package session_redis
+
+import (
+	"testing"
+
+	. "github.com/infrago/base"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/infrago/session"
+)
+
+// 连上一个内存里的 miniredis，测试结束时关闭
+func testConnect(t *testing.T, setting Map) (*redisConnect, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	if setting == nil {
+		setting = Map{}
+	}
+	setting["server"] = server.Addr()
+
+	connect, err := Driver().Connect(&session.Instance{Setting: setting})
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	conn := connect.(*redisConnect)
+	if err := conn.Open(); err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, server
+}
+
+// 读出会话，不存在时返回 nil
+func testRead(t *testing.T, conn *redisConnect, id string) []byte {
+	t.Helper()
+
+	data, err := conn.Read(id)
+	if err != nil && err != ErrNotFound {
+		t.Fatalf("read %s: %v", id, err)
+	}
+	return data
+}
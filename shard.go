@@ -0,0 +1,96 @@
+package session_redis
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 分片亲和，每个用户分配一个固定的 hashtag，记录在 Redis 里
+// 用户的会话和派生键都带上这个 hashtag，集群里落在同一个槽位，多键操作不会跨槽
+// 扩缩容迁移槽位时整组一起迁移，分配关系不变
+var (
+	errShardDisabled = errors.New("Session shard affinity disabled.")
+)
+
+// 取分配记录，没有时写入候选值，存在时续期
+var shardScript = redis.NewScript(1, `
+local shard = redis.call('GET', KEYS[1])
+if not shard then
+	shard = ARGV[1]
+end
+local expire = tonumber(ARGV[2])
+if expire > 0 then
+	redis.call('SET', KEYS[1], shard, 'PX', expire)
+else
+	redis.call('SET', KEYS[1], shard)
+end
+return shard
+`)
+
+// 检查分片亲和和其他配置的冲突
+func checkShard(setting redisSetting) error {
+	if !setting.Shard {
+		return nil
+	}
+	if setting.KeyEncoding != "" || setting.MaxKeyLength > 0 {
+		return errors.New("Invalid session setting, shard requires plain keys.")
+	}
+	return nil
+}
+
+// 用户分配到的分片，第一次调用时随机分配并记录，之后一直复用
+// 只读模式下只查不分配
+func (this *redisConnect) Shard(user string) (string, error) {
+	if this.client == nil {
+		return "", errInvalidCacheConnection
+	}
+	if !this.setting.Shard {
+		return "", errShardDisabled
+	}
+
+	key := this.setting.ShardPrefix + user
+	conn := this.conn(key)
+	defer conn.Close()
+
+	if this.ReadOnly() {
+		shard, err := redis.String(conn.Do("GET", key))
+		if err == redis.ErrNil {
+			return "", ErrReadOnly
+		}
+		if err != nil {
+			this.failed("shard", user, err)
+			return "", err
+		}
+		return shard, nil
+	}
+
+	candidate := "s" + strconv.FormatInt(rand.Int63n(this.setting.Shards), 10)
+	shard, err := redis.String(shardScript.Do(conn, key, candidate, this.setting.ShardExpire.Milliseconds()))
+	if err != nil {
+		this.failed("shard", user, err)
+		return "", err
+	}
+	return shard, nil
+}
+
+// 带上用户分片的会话ID，多租户时放在租户分隔符之后
+// 开启 hash_tag 的租户会话已经按租户落在同一个槽位，原样返回
+func (this *redisConnect) ShardID(user, id string) (string, error) {
+	if tenant := this.tenant(id); tenant != "" && this.setting.HashTag {
+		return id, nil
+	}
+
+	shard, err := this.Shard(user)
+	if err != nil {
+		return "", err
+	}
+
+	if tenant := this.tenant(id); tenant != "" {
+		size := len(tenant) + len(this.setting.TenantSeparator)
+		return id[:size] + "{" + shard + "}" + id[size:], nil
+	}
+	return "{" + shard + "}" + id, nil
+}
@@ -0,0 +1,105 @@
+package session_redis
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 共享连接池，同一个服务同时用 session-redis 和 cache-redis 并且指向同一个服务器时，共用一个 redigo 连接池
+// pool 为 *redis.Pool 或者登记过的名称，share_pool 把本实例的连接池按名称登记出去给别的模块用
+// 共享来的连接池由提供方负责建立和关闭，连接上没有本实例的初始化，因此不能和客户端缓存、
+// CLIENT NO-EVICT/NO-TOUCH 以及切换服务器地址的哨兵、SRV、Kubernetes 发现一起用，数据库也要一致
+var sharedPools = struct {
+	mutex sync.Mutex
+	pools map[string]*redis.Pool
+}{pools: map[string]*redis.Pool{}}
+
+// 登记共享的连接池，pool 为 nil 时取消登记
+func SharePool(name string, pool *redis.Pool) {
+	sharedPools.mutex.Lock()
+	defer sharedPools.mutex.Unlock()
+
+	if pool == nil {
+		delete(sharedPools.pools, name)
+		return
+	}
+	sharedPools.pools[name] = pool
+}
+
+// 登记过的共享连接池
+func SharedPool(name string) (*redis.Pool, bool) {
+	sharedPools.mutex.Lock()
+	defer sharedPools.mutex.Unlock()
+
+	pool, ok := sharedPools.pools[name]
+	return pool, ok
+}
+
+// 本实例的主连接池，Open 之后才有
+func (this *redisConnect) Pool() *redis.Pool {
+	return this.client
+}
+
+type (
+	redisShare struct {
+		pool  *redis.Pool //直接给的连接池
+		use   string      //按名称使用的连接池
+		share string      //登记出去的名称
+	}
+)
+
+// 解析 pool、share_pool 配置
+func parseShare(setting Map) redisShare {
+	share := redisShare{}
+	switch vv := setting["pool"].(type) {
+	case *redis.Pool:
+		share.pool = vv
+	case string:
+		share.use = vv
+	}
+	if vv, ok := setting["share_pool"].(string); ok {
+		share.share = vv
+	}
+	return share
+}
+
+// 使用共享连接池时不能开启的功能
+func checkShare(share redisShare, setting redisSetting, kubernetes bool) error {
+	if share.pool == nil && share.use == "" {
+		return nil
+	}
+	switch {
+	case setting.Cache:
+		return errors.New("Invalid session setting, cache requires an own pool.")
+	case setting.NoEvict || setting.NoTouch:
+		return errors.New("Invalid session setting, no_evict and no_touch require an own pool.")
+	case len(setting.Sentinels) > 0 || setting.Srv != "" || kubernetes:
+		return errors.New("Invalid session setting, server discovery requires an own pool.")
+	}
+	return nil
+}
+
+// 主连接池，共享的或者自己建立的
+func (this *redisConnect) primary() (*redis.Pool, error) {
+	if this.share.pool != nil {
+		return this.share.pool, nil
+	}
+	if this.share.use != "" {
+		pool, ok := SharedPool(this.share.use)
+		if !ok {
+			return nil, fmt.Errorf("Session shared pool %q not found.", this.share.use)
+		}
+		return pool, nil
+	}
+	return this.pool(""), nil
+}
+
+// 主连接池是不是共享来的
+func (this *redisConnect) borrowed() bool {
+	return this.share.pool != nil || this.share.use != ""
+}
@@ -0,0 +1,176 @@
+package session_redis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 会话快照，开启 snapshot 后可以把当前的值转储到带版本号的快照键里，保留 snapshot_ttl
+// 排查会话数据损坏，或者发版出问题后把用户的状态回滚到之前的快照
+var (
+	errSnapshotNotFound = errors.New("Session snapshot not found.")
+	errSnapshotDisabled = errors.New("Session snapshot disabled.")
+)
+
+// 转储到快照键，不存在返回 0，ARGV[1] 当前时间毫秒，ARGV[2] 保留时长毫秒，ARGV[3] 快照ID
+// 快照ID同时记进 KEYS[3] 的有序集合，按过期时间排序，过期的顺手清掉
+var snapshotScript = redis.NewScript(3, `
+local dump = redis.call('DUMP', KEYS[1])
+if not dump then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+local now = tonumber(ARGV[1])
+redis.call('HMSET', KEYS[2], 'dump', dump, 'ttl', ttl, 'at', ARGV[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now)
+redis.call('ZADD', KEYS[3], now + tonumber(ARGV[2]), ARGV[3])
+redis.call('PEXPIRE', KEYS[3], ARGV[2])
+return 1
+`)
+
+// 从快照键回滚，返回回滚后的过期毫秒，-1 快照不存在，-2 会话原本就会在此时过期，-3 租户超出配额
+// 会话还在时保留它当前的过期时间，不在时按快照记录的剩余时间扣掉经过的时间
+// KEYS[3] 为租户集合，会话不在时回滚等于新建，要检查配额，ARGV[2] 租户配额，ARGV[3] 集合成员
+var rollbackScript = redis.NewScript(3, `
+local v = redis.call('HMGET', KEYS[2], 'dump', 'ttl', 'at')
+if not v[1] then
+	return -1
+end
+local now = tonumber(ARGV[1])
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	ttl = tonumber(v[2])
+	if ttl > 0 then
+		ttl = ttl - (now - tonumber(v[3]))
+		if ttl <= 0 then
+			return -2
+		end
+	end
+	if KEYS[3] ~= '' then
+		redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now)
+		local quota = tonumber(ARGV[2])
+		if quota > 0 and redis.call('ZCARD', KEYS[3]) >= quota then
+			return -3
+		end
+	end
+end
+if ttl < 0 then
+	ttl = 0
+end
+redis.call('RESTORE', KEYS[1], ttl, v[1], 'REPLACE')
+if KEYS[3] ~= '' then
+	if ttl > 0 then
+		redis.call('ZADD', KEYS[3], now + ttl, ARGV[3])
+	else
+		redis.call('ZADD', KEYS[3], '+inf', ARGV[3])
+	end
+end
+return ttl
+`)
+
+// 快照键
+func (this *redisConnect) snapshotKey(id, snapshot string) string {
+	return this.sideKey(this.setting.SnapshotPrefix, id) + ":" + snapshot
+}
+
+// 会话的快照ID集合，快照ID不会是空的，借用空ID的快照键
+func (this *redisConnect) snapshotsKey(id string) string {
+	return this.snapshotKey(id, "")
+}
+
+// 会话现有的全部快照ID，集合和会话键在同一个槽位
+func (this *redisConnect) snapshots(conn redis.Conn, id string) ([]string, error) {
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", this.snapshotsKey(id), "("+strconv.FormatInt(ms, 10), "+inf"))
+}
+
+// 给会话的当前值拍快照，返回快照ID，会话不存在返回 ErrNotFound
+func (this *redisConnect) Snapshot(id string) (string, error) {
+	if this.client == nil {
+		return "", errInvalidCacheConnection
+	}
+	if !this.setting.Snapshot {
+		return "", errSnapshotDisabled
+	}
+	if err := this.writable(); err != nil {
+		return "", err
+	}
+	this.flush(id)
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	now := time.Now()
+	snapshot := strconv.FormatInt(now.UnixNano(), 36)
+	ms := now.UnixNano() / int64(time.Millisecond)
+
+	ok, err := redis.Int(snapshotScript.Do(
+		conn, this.key(id), this.snapshotKey(id, snapshot), this.snapshotsKey(id),
+		ms, this.setting.SnapshotTTL.Milliseconds(), snapshot,
+	))
+	if err != nil {
+		this.failed("snapshot", id, err)
+		return "", err
+	}
+	if ok == 0 {
+		return "", ErrNotFound
+	}
+
+	this.metric("session.snapshot", 1)
+	return snapshot, nil
+}
+
+// 把会话回滚到快照，快照保留到过期，可以反复回滚
+func (this *redisConnect) Rollback(id, snapshot string) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if !this.setting.Snapshot {
+		return errSnapshotDisabled
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+	if snapshot == "" {
+		return errSnapshotNotFound
+	}
+	this.uncoalesce(id)
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	tenant, tenantKey := this.tenant(id), ""
+	if tenant != "" {
+		tenantKey = this.tenantKey(tenant)
+	}
+
+	ms := time.Now().UnixNano() / int64(time.Millisecond)
+	ttl, err := redis.Int64(rollbackScript.Do(
+		conn, this.key(id), this.snapshotKey(id, snapshot), tenantKey, ms, this.tenantQuota(tenant), id,
+	))
+	if err != nil {
+		this.failed("rollback", id, err)
+		return err
+	}
+	switch ttl {
+	case -1:
+		return errSnapshotNotFound
+	case -2:
+		return ErrNotFound
+	case -3:
+		return &QuotaError{Tenant: tenant, Quota: this.tenantQuota(tenant)}
+	}
+
+	expire := time.Duration(ttl) * time.Millisecond
+	this.uncache(this.key(id))
+	this.reindex(conn, "rollback", id, expire)
+
+	this.metric("session.rollback", 1)
+	this.warning("session.redis.rollback", id, snapshot)
+	this.emit(EventWrite, id, expire)
+	return nil
+}
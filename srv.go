@@ -0,0 +1,42 @@
+package session_redis
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNS SRV 服务发现，server 配置为 srv://_redis._tcp.example.com，定时重新解析
+// 当前地址还在记录里就不切换
+const (
+	srvScheme = "srv://"
+)
+
+var (
+	errNoSrvRecord = errors.New("No session srv record.")
+)
+
+func (this *redisConnect) discoverSrv() error {
+	_, records, err := net.LookupSRV("", "", this.setting.Srv)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errNoSrvRecord
+	}
+
+	current := this.server()
+	addrs := make([]string, 0, len(records))
+	for _, record := range records {
+		addr := net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port)))
+		if addr == current {
+			return nil
+		}
+		addrs = append(addrs, addr)
+	}
+
+	//LookupSRV 已经按优先级排序，同优先级按权重随机
+	this.switchServer(addrs[0])
+	return nil
+}
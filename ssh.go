@@ -0,0 +1,160 @@
+package session_redis
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH 隧道，通过跳板机访问私有网络里的托管 Redis，开发和运维工具使用
+const (
+	sshTimeout = time.Second * 10
+)
+
+var (
+	errSSHHostKey = errors.New("Invalid session ssh setting, known_hosts or host_key required.")
+)
+
+type (
+	redisSSH struct {
+		Host string //跳板机地址，host:port
+		User string
+
+		config *ssh.ClientConfig
+		mutex  sync.Mutex
+		client *ssh.Client
+	}
+)
+
+// 解析配置，ssh = { host, user, key, passphrase, password, known_hosts, host_key, insecure }
+// key 可以是 PEM 内容或者文件路径，主机密钥必须校验，除非显式配置 insecure
+func parseSSH(setting Map) (*redisSSH, error) {
+	config, ok := setting["ssh"].(Map)
+	if !ok {
+		return nil, nil
+	}
+
+	tunnel := &redisSSH{}
+	if vv, ok := config["host"].(string); ok && vv != "" {
+		tunnel.Host = vv
+	}
+	if vv, ok := config["user"].(string); ok && vv != "" {
+		tunnel.User = vv
+	}
+	if tunnel.Host == "" || tunnel.User == "" {
+		return nil, errors.New("Invalid session ssh setting, host and user required.")
+	}
+	if _, _, err := net.SplitHostPort(tunnel.Host); err != nil {
+		tunnel.Host = net.JoinHostPort(tunnel.Host, "22")
+	}
+
+	auths := []ssh.AuthMethod{}
+	if vv, ok := config["key"].(string); ok && vv != "" {
+		pem, err := loadPEM(vv)
+		if err != nil {
+			return nil, err
+		}
+		var signer ssh.Signer
+		if passphrase, ok := config["passphrase"].(string); ok && passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(pem)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auths = append(auths, ssh.PublicKeys(signer))
+	}
+	if vv, ok := config["password"].(string); ok && vv != "" {
+		auths = append(auths, ssh.Password(vv))
+	}
+	if len(auths) == 0 {
+		return nil, errors.New("Invalid session ssh setting, key or password required.")
+	}
+
+	var callback ssh.HostKeyCallback
+	if vv, ok := config["host_key"].(string); ok && vv != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(vv))
+		if err != nil {
+			return nil, err
+		}
+		callback = ssh.FixedHostKey(key)
+	} else if vv, ok := config["known_hosts"].(string); ok && vv != "" {
+		known, err := knownhosts.New(vv)
+		if err != nil {
+			return nil, err
+		}
+		callback = known
+	} else if vv, ok := config["insecure"].(bool); ok && vv {
+		callback = ssh.InsecureIgnoreHostKey()
+	} else {
+		return nil, errSSHHostKey
+	}
+
+	tunnel.config = &ssh.ClientConfig{
+		User: tunnel.User, Auth: auths, HostKeyCallback: callback, Timeout: sshTimeout,
+	}
+	return tunnel, nil
+}
+
+// 通过隧道建立到 addr 的连接，跳板机连接断开时重连一次
+func (this *redisConnect) sshDial(network, addr string) (net.Conn, error) {
+	client, err := this.ssh.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := client.Dial(network, addr)
+	if err == nil {
+		return conn, nil
+	}
+
+	this.ssh.reset(client)
+	if client, err = this.ssh.connect(); err != nil {
+		return nil, err
+	}
+	return client.Dial(network, addr)
+}
+
+// 跳板机连接，所有隧道共用一个
+func (this *redisSSH) connect() (*ssh.Client, error) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.client != nil {
+		return this.client, nil
+	}
+	client, err := ssh.Dial("tcp", this.Host, this.config)
+	if err != nil {
+		return nil, err
+	}
+	this.client = client
+	return client, nil
+}
+
+// 丢弃失效的跳板机连接
+func (this *redisSSH) reset(client *ssh.Client) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.client == client {
+		this.client.Close()
+		this.client = nil
+	}
+}
+
+func (this *redisSSH) close() {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	if this.client != nil {
+		this.client.Close()
+		this.client = nil
+	}
+}
@@ -0,0 +1,112 @@
+package session_redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// Stats 会话存储的容量统计
+	Stats struct {
+		Sessions int64 //前缀下的会话数
+		Sampled  int64 //采样 MEMORY USAGE 的会话数
+		Memory   int64 //按采样均值估算的总内存字节数
+
+		Writes     int64   //本实例打开以来的写入次数
+		Deletes    int64   //本实例打开以来的删除次数
+		WriteRate  float64 //每秒写入次数
+		DeleteRate float64 //每秒删除次数
+
+		Expired int64         //服务器累计过期的键数，整个服务器的，不区分前缀
+		Elapsed time.Duration //本实例打开以来的时长
+
+		Instance string //实例名
+		Server   string //服务器地址
+	}
+)
+
+// 会话统计，做容量规划不用再上 redis-cli 翻
+// 前缀下的会话全部 SCAN 计数，内存只对前 sample 个会话取 MEMORY USAGE 再按均值估算
+func (this *redisConnect) Stats(prefix string, sample int) (Stats, error) {
+	stats := Stats{}
+	if this.client == nil {
+		return stats, errInvalidCacheConnection
+	}
+
+	sampled := int64(0)
+	err := this.masters(func(conn redis.Conn) error {
+		err := this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			measure := []string{}
+			for _, key := range keys {
+				if _, ok := this.id(key); !ok {
+					continue
+				}
+				stats.Sessions++
+				if stats.Sampled+int64(len(measure)) < int64(sample) {
+					measure = append(measure, key)
+				}
+			}
+			for _, key := range measure {
+				conn.Send("MEMORY", "USAGE", key)
+			}
+			if err := conn.Flush(); err != nil {
+				return err
+			}
+			for range measure {
+				size, err := redis.Int64(conn.Receive())
+				if err == redis.ErrNil {
+					continue
+				}
+				if err != nil {
+					return err
+				}
+				stats.Sampled++
+				sampled += size
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		//过期数按主节点累加
+		if info, err := redis.String(conn.Do("INFO", "stats")); err == nil {
+			stats.Expired += infoInt(info, "expired_keys")
+		}
+		return nil
+	})
+	if err != nil {
+		this.failed("stats", prefix, err)
+		return stats, err
+	}
+
+	if stats.Sampled > 0 {
+		stats.Memory = sampled * stats.Sessions / stats.Sampled
+	}
+
+	labels := this.Labels()
+	stats.Instance, _ = labels["instance"].(string)
+	stats.Server, _ = labels["server"].(string)
+
+	metrics := this.Metrics()
+	stats.Writes, _ = metrics["session.write"].(int64)
+	stats.Deletes, _ = metrics["session.delete"].(int64)
+	if !this.metrics.opened.IsZero() {
+		stats.Elapsed = time.Since(this.metrics.opened)
+	}
+	if seconds := stats.Elapsed.Seconds(); seconds > 0 {
+		stats.WriteRate = float64(stats.Writes) / seconds
+		stats.DeleteRate = float64(stats.Deletes) / seconds
+	}
+
+	return stats, nil
+}
+
+// INFO 输出里的整数字段
+func infoInt(info, field string) int64 {
+	value, _ := strconv.ParseInt(infoString(info, field), 10, 64)
+	return value
+}
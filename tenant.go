@@ -0,0 +1,130 @@
+package session_redis
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("Session quota exceeded.")
+)
+
+// 租户会话写入，会话集合按过期时间排序，写入新会话前先清掉已过期的成员再检查配额
+var tenantWriteScript = redis.NewScript(2, `
+local now = tonumber(ARGV[4])
+local expire = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	local quota = tonumber(ARGV[3])
+	if quota > 0 and redis.call('ZCARD', KEYS[2]) >= quota then
+		return 0
+	end
+end
+if expire > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', expire)
+	redis.call('ZADD', KEYS[2], now + expire, ARGV[5])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+	redis.call('ZADD', KEYS[2], '+inf', ARGV[5])
+end
+return 1
+`)
+
+// 租户会话删除，同时移出会话集合
+var tenantRemoveScript = redis.NewScript(2, `
+redis.call('ZREM', KEYS[2], ARGV[1])
+return redis.call('DEL', KEYS[1])
+`)
+
+type (
+	// QuotaError 租户会话数超出配额
+	QuotaError struct {
+		Tenant string
+		Quota  int64
+	}
+)
+
+func (err *QuotaError) Error() string {
+	return fmt.Sprintf("Session quota exceeded for tenant %s, quota %d.", err.Tenant, err.Quota)
+}
+
+// 使 errors.Is(err, ErrQuotaExceeded) 成立
+func (err *QuotaError) Is(target error) bool {
+	return target == ErrQuotaExceeded
+}
+
+// 从会话ID中取租户，未开启多租户或ID不含租户时返回空
+func (this *redisConnect) tenant(id string) string {
+	if !this.setting.Tenant {
+		return ""
+	}
+	if pos := strings.Index(id, this.setting.TenantSeparator); pos > 0 {
+		return id[:pos]
+	}
+	return ""
+}
+
+// 租户配额
+func (this *redisConnect) tenantQuota(tenant string) int64 {
+	if quota, ok := this.setting.TenantQuotas[tenant]; ok {
+		return quota
+	}
+	return this.setting.TenantQuota
+}
+
+// 租户会话集合的键，不带分隔符，不会和会话键冲突
+func (this *redisConnect) tenantKey(tenant string) string {
+	if this.setting.HashTag {
+		return this.setting.TenantPrefix + "{" + tenant + "}"
+	}
+	return this.setting.TenantPrefix + tenant
+}
+
+func (this *redisConnect) tenantWrite(conn redis.Conn, tenant, id, value string, expire time.Duration) error {
+	quota := this.tenantQuota(tenant)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	ok, err := redis.Int(tenantWriteScript.Do(
+		conn, this.key(id), this.tenantKey(tenant),
+		value, expire.Milliseconds(), quota, now, id,
+	))
+	if err != nil {
+		this.failed("write", id, err)
+		return err
+	}
+	if ok == 0 {
+		return &QuotaError{Tenant: tenant, Quota: quota}
+	}
+
+	return nil
+}
+
+func (this *redisConnect) tenantRemove(conn redis.Conn, tenant, id string) error {
+	_, err := tenantRemoveScript.Do(conn, this.key(id), this.tenantKey(tenant), id)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// 租户当前有效会话数
+func (this *redisConnect) TenantCount(tenant string) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+
+	conn := this.conn(this.tenantKey(tenant))
+	defer conn.Close()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	count, err := redis.Int64(conn.Do("ZCOUNT", this.tenantKey(tenant), now, "+inf"))
+	if err != nil {
+		this.failed("tenant", tenant, err)
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,62 @@
+package session_redis
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+)
+
+var (
+	errInvalidCertificate = errors.New("Invalid session tls certificate.")
+)
+
+// PEM 可以直接写内容，也可以是文件路径
+func loadPEM(value string) ([]byte, error) {
+	if strings.HasPrefix(strings.TrimSpace(value), "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// 按当前的 TLS 配置生成 tls.Config，证书材料可能在运行中被刷新，每次都在锁里读
+func (this *redisConnect) tlsConfig() (*tls.Config, error) {
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	config := &tls.Config{
+		ServerName:         this.setting.TLSServerName,
+		InsecureSkipVerify: this.setting.TLSSkipVerify,
+	}
+
+	if this.setting.TLSCA != "" {
+		ca, err := loadPEM(this.setting.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errInvalidCertificate
+		}
+		config.RootCAs = pool
+	}
+
+	if this.setting.TLSCert != "" && this.setting.TLSKey != "" {
+		cert, err := loadPEM(this.setting.TLSCert)
+		if err != nil {
+			return nil, err
+		}
+		key, err := loadPEM(this.setting.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		pair, err := tls.X509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,64 @@
+package session_redis
+
+import (
+	"strings"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+type (
+	// Tracer 返回当前的追踪标识，比如 trace id 的前几位，没有时返回空
+	// 开启后每次借连接都用 CLIENT SETNAME 把标识写到连接名上，排查故障时 MONITOR、CLIENT LIST 的输出能对上应用的追踪
+	// 每次借连接多一次往返，只在需要时开启
+	Tracer func() string
+)
+
+// 连接名的最大长度，太长的标识截断
+const traceNameMax = 64
+
+// 解析 tracer 配置
+func parseTracer(setting Map) Tracer {
+	switch vv := setting["tracer"].(type) {
+	case Tracer:
+		return vv
+	case func() string:
+		return vv
+	}
+	return nil
+}
+
+// 给借出的连接设置连接名，没有追踪标识时恢复为实例名，避免沿用上一次借出时的标识
+func (this *redisConnect) trace(conn redis.Conn) {
+	if this.tracer == nil || conn.Err() != nil || this.disabled("CLIENT") {
+		return
+	}
+
+	name := "session"
+	if this.instance != nil && this.instance.Name != "" {
+		name += "-" + this.instance.Name
+	}
+	if id := this.tracer(); id != "" {
+		name += "-" + id
+	}
+	name = traceName(name)
+
+	if _, err := conn.Do("CLIENT", "SETNAME", name); err != nil {
+		this.metric("trace.failed", 1)
+	}
+}
+
+// 连接名不能有空格和换行
+func traceName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > traceNameMax {
+		name = name[:traceNameMax]
+	}
+	return name
+}
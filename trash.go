@@ -0,0 +1,224 @@
+package session_redis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 软删除，开启 soft_delete 时 Delete 不直接删除，把会话转储到回收键里保留一段时间
+// 窗口内可以 Restore 恢复，误操作批量注销或者撤销退出登录时用，过了窗口回收键自然过期
+// 转储用 DUMP/RESTORE，字符串和哈希存储的会话都能原样恢复，剩余的过期时间也一起恢复
+
+// 转储到回收键，ARGV[1] 当前时间毫秒，ARGV[2] 保留时长毫秒，ARGV[3] 所属用户
+var trashScript = redis.NewScript(2, `
+local dump = redis.call('DUMP', KEYS[1])
+if not dump then
+	return 0
+end
+local ttl = redis.call('PTTL', KEYS[1])
+redis.call('DEL', KEYS[2])
+redis.call('HMSET', KEYS[2], 'dump', dump, 'ttl', ttl, 'at', ARGV[1], 'user', ARGV[3])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// 从回收键恢复，返回 {状态, 剩余过期毫秒, 所属用户}
+// 状态 1 恢复成功，0 不在回收窗口内或者已经过期，-1 同ID已经有新会话，-2 租户超出配额
+// KEYS[3] 为租户集合，ARGV[2] 租户配额，ARGV[3] 集合成员
+var restoreScript = redis.NewScript(3, `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return {-1, 0, ''}
+end
+local v = redis.call('HMGET', KEYS[2], 'dump', 'ttl', 'at', 'user')
+if not v[1] then
+	return {0, 0, ''}
+end
+local now = tonumber(ARGV[1])
+local ttl = tonumber(v[2])
+if ttl > 0 then
+	ttl = ttl - (now - tonumber(v[3]))
+	if ttl <= 0 then
+		redis.call('DEL', KEYS[2])
+		return {0, 0, ''}
+	end
+else
+	ttl = 0
+end
+if KEYS[3] ~= '' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', now)
+	local quota = tonumber(ARGV[2])
+	if quota > 0 and redis.call('ZCARD', KEYS[3]) >= quota then
+		return {-2, 0, ''}
+	end
+end
+redis.call('RESTORE', KEYS[1], ttl, v[1])
+redis.call('DEL', KEYS[2])
+if KEYS[3] ~= '' then
+	if ttl > 0 then
+		redis.call('ZADD', KEYS[3], now + ttl, ARGV[3])
+	else
+		redis.call('ZADD', KEYS[3], '+inf', ARGV[3])
+	end
+end
+return {1, ttl, v[4] or ''}
+`)
+
+// 回收键
+func (this *redisConnect) trashKey(id string) string {
+	return this.sideKey(this.setting.TrashPrefix, id)
+}
+
+// 会话的附属键，集群模式下和会话键放在同一个槽位
+func (this *redisConnect) sideKey(prefix, id string) string {
+	key := this.key(id)
+	if this.setting.Cluster && !hashTagged(key) {
+		return prefix + "{" + key + "}"
+	}
+	return prefix + key
+}
+
+// 键里是否有非空的 hashtag
+func hashTagged(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] == '{' {
+			for j := i + 1; j < len(key); j++ {
+				if key[j] == '}' {
+					return j > i+1
+				}
+			}
+			return false
+		}
+	}
+	return false
+}
+
+// 软删除，租户集合和索引照常移除，所属用户记在回收键里，恢复时重新关联
+func (this *redisConnect) trash(conn redis.Conn, id string) error {
+	this.uncache(this.key(id))
+
+	user := ""
+	if this.setting.Index {
+		owner, err := this.owner(id)
+		if err != nil {
+			return err
+		}
+		user = owner
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	trashed, err := redis.Int(trashScript.Do(
+		conn, this.key(id), this.trashKey(id), now, this.setting.SoftDelete.Milliseconds(), user,
+	))
+	if err != nil {
+		return err
+	}
+
+	if this.setting.Index {
+		this.indexRemove(id)
+	}
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZREM", this.tenantKey(tenant), id); err != nil {
+			return err
+		}
+	}
+	this.keyForget(conn, id)
+
+	if trashed == 1 {
+		this.retain(user, id)
+		this.metric("session.delete", 1)
+		this.metric("session.trash", 1)
+		this.emit(EventDelete, id, 0)
+	}
+	return nil
+}
+
+// 恢复软删除的会话，返回是否恢复
+// 超过 soft_delete 窗口、会话本来就过期了、或者同ID已经写入了新会话时返回 false
+func (this *redisConnect) Restore(id string) (bool, error) {
+	if this.client == nil {
+		return false, errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return false, err
+	}
+	if this.setting.SoftDelete <= 0 {
+		return false, nil
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	//用户执行过 Erase，之前软删除的会话不能再恢复和关联回去
+	if this.setting.Index {
+		trashed, err := redis.Strings(conn.Do("HMGET", this.trashKey(id), "user", "at"))
+		if err != nil {
+			this.failed("restore", id, err)
+			return false, err
+		}
+		if len(trashed) == 2 && trashed[0] != "" {
+			at, _ := strconv.ParseInt(trashed[1], 10, 64)
+			erased, err := this.erasedSince(trashed[0], at)
+			if err != nil {
+				this.failed("restore", id, err)
+				return false, err
+			}
+			if erased {
+				if _, err := conn.Do("DEL", this.trashKey(id)); err != nil {
+					this.failed("restore", id, err)
+				}
+				return false, nil
+			}
+		}
+	}
+
+	//租户会话恢复时同样占配额，超出时回收键保留，腾出位置后还能再恢复
+	tenant, tenantKey := this.tenant(id), ""
+	if tenant != "" {
+		tenantKey = this.tenantKey(tenant)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	vals, err := redis.Values(restoreScript.Do(
+		conn, this.key(id), this.trashKey(id), tenantKey, now, this.tenantQuota(tenant), id,
+	))
+	if err != nil {
+		this.failed("restore", id, err)
+		return false, err
+	}
+	var status, ttl int64
+	var user string
+	if _, err := redis.Scan(vals, &status, &ttl, &user); err != nil {
+		return false, err
+	}
+	if status == -2 {
+		return false, &QuotaError{Tenant: tenant, Quota: this.tenantQuota(tenant)}
+	}
+	if status != 1 {
+		return false, nil
+	}
+
+	expire := time.Duration(ttl) * time.Millisecond
+	this.uncache(this.key(id))
+	this.reindex(conn, "restore", id, expire)
+	if this.setting.Index && user != "" {
+		if err := this.Bind(user, id); err != nil {
+			this.failed("restore", id, err)
+		}
+		this.unretain(user, id)
+	}
+
+	this.metric("session.restore", 1)
+	this.emit(EventWrite, id, expire)
+	return true, nil
+}
+
+// 会话键被 RESTORE 回来以后，补回原始ID和过期索引，租户集合在脚本里连同配额一起处理
+func (this *redisConnect) reindex(conn redis.Conn, op, id string, expire time.Duration) {
+	this.keyRemember(conn, id)
+	if this.setting.Index {
+		this.indexWrite(id, expire)
+	}
+}
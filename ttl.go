@@ -0,0 +1,108 @@
+package session_redis
+
+import (
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 剩余过期时间的分布，桶的上限，最后一个桶不设上限
+var ttlBounds = []time.Duration{
+	time.Minute, time.Minute * 5, time.Minute * 15, time.Hour, time.Hour * 6,
+	time.Hour * 24, time.Hour * 24 * 7, time.Hour * 24 * 30,
+}
+
+type (
+	// TTLBucket 剩余过期时间不超过 Max 的会话数，Max 为 0 表示不设上限
+	TTLBucket struct {
+		Max   time.Duration
+		Count int64
+	}
+
+	// TTLReport 前缀下会话剩余过期时间的采样分布
+	TTLReport struct {
+		Sampled    int64         //采样的会话数
+		Persistent int64         //没有设置过期时间的会话数
+		Min        time.Duration //最短的剩余时间
+		Max        time.Duration //最长的剩余时间
+		Buckets    []TTLBucket
+	}
+)
+
+// 采样前缀下最多 sample 个会话的剩余过期时间，按桶统计
+// 找没设过期时间的会话，或者过期时间明显不对的写入
+func (this *redisConnect) TTLReport(prefix string, sample int) (TTLReport, error) {
+	report := TTLReport{Buckets: make([]TTLBucket, len(ttlBounds)+1)}
+	for i, bound := range ttlBounds {
+		report.Buckets[i].Max = bound
+	}
+	if this.client == nil {
+		return report, errInvalidCacheConnection
+	}
+
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			measure := []string{}
+			for _, key := range keys {
+				if _, ok := this.id(key); !ok {
+					continue
+				}
+				if report.Sampled+int64(len(measure)) >= int64(sample) {
+					break
+				}
+				measure = append(measure, key)
+			}
+			for _, key := range measure {
+				conn.Send("PTTL", key)
+			}
+			if err := conn.Flush(); err != nil {
+				return err
+			}
+			for range measure {
+				ms, err := redis.Int64(conn.Receive())
+				if err != nil {
+					return err
+				}
+				report.add(ms)
+			}
+			if report.Sampled >= int64(sample) {
+				return errStopped
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopped {
+		this.failed("ttlreport", prefix, err)
+		return report, err
+	}
+
+	return report, nil
+}
+
+// 计入一个 PTTL 结果，-2 是扫描之后已经过期的键，不计
+func (report *TTLReport) add(ms int64) {
+	if ms == -2 {
+		return
+	}
+	report.Sampled++
+	if ms == -1 {
+		report.Persistent++
+		return
+	}
+
+	ttl := time.Duration(ms) * time.Millisecond
+	if report.Sampled-report.Persistent == 1 || ttl < report.Min {
+		report.Min = ttl
+	}
+	if ttl > report.Max {
+		report.Max = ttl
+	}
+	for i, bound := range ttlBounds {
+		if ttl <= bound {
+			report.Buckets[i].Count++
+			return
+		}
+	}
+	report.Buckets[len(ttlBounds)].Count++
+}
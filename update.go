@@ -0,0 +1,257 @@
+package session_redis
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+var (
+	ErrUpdateConflict = errors.New("Session update conflict.")
+)
+
+// 乐观并发更新，WATCH/GET/MULTI/SET，期间会话被别人改过就重试，超过次数返回 ErrUpdateConflict
+// fn 拿到的是当前内容，不存在时为 nil，返回 nil 表示删除会话，过期时间保持不变
+// 和 Write、Delete 一样过校验器、记录历史、软删除、发变更事件，维护窗口中按排队的数据更新后排队
+// 租户会话通过 Update 新建时同样检查配额
+func (this *redisConnect) Update(id string, fn func(old []byte) ([]byte, error)) error {
+	return this.intercept("update", id, func() error {
+		return this.update(id, 0, fn)
+	})
+}
+
+// expire 大于0时改用新的过期时间，否则保持不变
+func (this *redisConnect) update(id string, expire time.Duration, fn func(old []byte) ([]byte, error)) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if this.Maintaining() {
+		return this.updateQueued(id, expire, fn)
+	}
+	this.flush(id)
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	key := this.key(id)
+	tenant := this.tenant(id)
+	soft := this.setting.SoftDelete > 0
+
+	for i := 0; i < this.setting.UpdateRetries; i++ {
+		if _, err := conn.Do("WATCH", key); err != nil {
+			this.failed("update", id, err)
+			return err
+		}
+
+		conn.Send("GET", key)
+		conn.Send("PTTL", key)
+		if err := conn.Flush(); err != nil {
+			return err
+		}
+		value, err := redis.String(conn.Receive())
+		if err != nil && err != redis.ErrNil {
+			conn.Do("UNWATCH")
+			this.failed("update", id, err)
+			return err
+		}
+		found := err == nil
+		existed := found && value != this.tombstone()
+		ttl, err := redis.Int64(conn.Receive())
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+		if expire > 0 {
+			ttl = expire.Milliseconds()
+		}
+
+		//墓碑按不存在处理
+		var old []byte
+		if existed && value != "" {
+			if old, err = this.decode(id, value); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		} else if existed {
+			old = []byte{}
+		}
+
+		data, err := fn(old)
+		if err == nil && len(data) > 0 {
+			data, err = this.validate(id, data)
+		}
+		if err != nil {
+			conn.Do("UNWATCH")
+			return err
+		}
+
+		if len(data) > 0 {
+			if value, err = this.marshal(id, data, false); err == nil {
+				value, err = this.limit(id, data, value)
+			}
+			if err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		if len(data) > 0 && !found && tenant != "" {
+			if err := this.updateQuota(conn, tenant, now); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		user := ""
+		if len(data) == 0 && soft && this.setting.Index {
+			if user, err = this.owner(id); err != nil {
+				conn.Do("UNWATCH")
+				return err
+			}
+		}
+
+		conn.Send("MULTI")
+		if len(data) == 0 {
+			if soft {
+				trashScript.Send(conn, key, this.trashKey(id), now, this.setting.SoftDelete.Milliseconds(), user)
+			} else {
+				conn.Send("DEL", key)
+			}
+			if tenant != "" {
+				conn.Send("ZREM", this.tenantKey(tenant), id)
+			}
+		} else {
+			if this.setting.History > 0 {
+				historyScript.Send(conn, key, this.historyKey(id), this.setting.History, this.setting.HistoryTTL.Milliseconds(), this.tombstone())
+			}
+			if ttl > 0 {
+				conn.Send("SET", key, value, "PX", ttl)
+			} else {
+				conn.Send("SET", key, value)
+			}
+			if tenant != "" {
+				var score Any = "+inf"
+				if ttl > 0 {
+					score = now + ttl
+				}
+				conn.Send("ZADD", this.tenantKey(tenant), score, id)
+			}
+		}
+
+		reply, err := conn.Do("EXEC")
+		if err != nil {
+			this.failed("update", id, err)
+			return err
+		}
+		//nil 表示 WATCH 的键被改过，事务没有执行
+		if reply == nil {
+			continue
+		}
+
+		this.uncache(key)
+		expire = 0
+		if ttl > 0 {
+			expire = time.Duration(ttl) * time.Millisecond
+		}
+		if len(data) == 0 {
+			if this.setting.Index {
+				this.indexRemove(id)
+			}
+			this.keyForget(conn, id)
+			if existed {
+				if soft {
+					this.retain(user, id)
+					this.metric("session.trash", 1)
+				}
+				this.metric("session.delete", 1)
+				this.emit(EventDelete, id, 0)
+			}
+			return nil
+		}
+
+		if this.setting.Index {
+			this.indexWrite(id, expire)
+		}
+		this.keyRemember(conn, id)
+		this.metric("session.write", 1)
+		this.emit(EventWrite, id, expire)
+		return nil
+	}
+
+	return ErrUpdateConflict
+}
+
+// 新建租户会话前检查配额，已过期的成员不算
+// 同时监视租户集合，检查之后别的会话加入时事务不执行，重试
+func (this *redisConnect) updateQuota(conn redis.Conn, tenant string, now int64) error {
+	quota := this.tenantQuota(tenant)
+	if quota <= 0 {
+		return nil
+	}
+	if _, err := conn.Do("WATCH", this.tenantKey(tenant)); err != nil {
+		return err
+	}
+	count, err := redis.Int64(conn.Do("ZCOUNT", this.tenantKey(tenant), "("+strconv.FormatInt(now, 10), "+inf"))
+	if err != nil {
+		return err
+	}
+	if count >= quota {
+		return &QuotaError{Tenant: tenant, Quota: quota}
+	}
+	return nil
+}
+
+// 维护窗口中的更新，按排队的数据或者服务器上的数据算出新值，再照常排队
+func (this *redisConnect) updateQueued(id string, renew time.Duration, fn func(old []byte) ([]byte, error)) error {
+	this.maintenance.mutex.Lock()
+	write, queued := this.maintenance.pending[id]
+	this.maintenance.mutex.Unlock()
+
+	var old []byte
+	expire := time.Duration(0)
+	if queued && !write.deleted {
+		old = write.data
+		if write.expire > 0 {
+			if expire = write.expire - time.Since(write.at); expire <= 0 {
+				old = nil
+			}
+		}
+	} else {
+		conn := this.conn(this.key(id))
+		conn.Send("GET", this.key(id))
+		conn.Send("PTTL", this.key(id))
+		conn.Flush()
+		value, err := redis.String(conn.Receive())
+		ttl, _ := redis.Int64(conn.Receive())
+		conn.Close()
+		if err != nil && err != redis.ErrNil {
+			this.failed("update", id, err)
+			return err
+		}
+		if err == nil && value != this.tombstone() {
+			if old, err = this.decode(id, value); err != nil {
+				return err
+			}
+		}
+		if ttl > 0 {
+			expire = time.Duration(ttl) * time.Millisecond
+		}
+	}
+
+	data, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return this.del(id)
+	}
+	if renew > 0 {
+		expire = renew
+	}
+	return this.save(id, data, expire)
+}
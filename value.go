@@ -0,0 +1,525 @@
+package session_redis
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 读取并删除，一次性的值，比如闪存消息、CSRF随机数、单次令牌
+// 优先使用 GETDEL，老版本的服务器不支持时用事务执行 GET+DEL
+func (this *redisConnect) ReadOnce(id string) (data []byte, err error) {
+	err = this.intercept("readonce", id, func() error {
+		data, err = this.readOnce(id)
+		return err
+	})
+	return data, err
+}
+
+func (this *redisConnect) readOnce(id string) ([]byte, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	this.flush(id)
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	key := this.key(id)
+
+	var value string
+	var err error
+	if !this.capable("GETDEL") {
+		value, err = this.getdel(conn, key)
+	} else {
+		value, err = redis.String(conn.Do("GETDEL", key))
+		if err != nil && isUnknownCommand(err) {
+			value, err = this.getdel(conn, key)
+		}
+	}
+	if err != nil && err != redis.ErrNil {
+		this.failed("readonce", id, err)
+		return nil, err
+	}
+
+	//租户会话要同时移出计数
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZREM", this.tenantKey(tenant), id); err != nil {
+			this.failed("readonce", id, err)
+		}
+	}
+	if this.setting.Index {
+		this.indexRemove(id)
+	}
+
+	if err == redis.ErrNil || value == this.tombstone() {
+		return nil, this.missing()
+	}
+	this.emit(EventDelete, id, 0)
+	if value == "" {
+		return []byte{}, nil
+	}
+
+	return this.decode(id, value)
+}
+
+// 事务方式的 GET+DEL
+func (this *redisConnect) getdel(conn redis.Conn, key string) (string, error) {
+	conn.Send("MULTI")
+	conn.Send("GET", key)
+	conn.Send("DEL", key)
+	vals, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	if len(vals) == 0 {
+		return "", redis.ErrNil
+	}
+	return redis.String(vals[0], nil)
+}
+
+// 服务器不支持的命令
+func isUnknownCommand(err error) bool {
+	if err == nil {
+		return false
+	}
+	if _, ok := err.(redis.Error); !ok {
+		return false
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "unknown command")
+}
+
+var (
+	errCounterDisabled = errors.New("Session counter disabled.")
+)
+
+// 原子计数，返回增加后的值，expire大于0时同时刷新过期时间
+// 计数按整数原样存储在 counter_prefix 下，不经过会话数据的编码，不算会话，要开启 counter
+func (this *redisConnect) Increase(key string, delta int64, expire time.Duration) (int64, error) {
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+	if !this.setting.Counter {
+		return 0, errCounterDisabled
+	}
+	if err := this.writable(); err != nil {
+		return 0, err
+	}
+
+	key = this.counterKey(key)
+
+	conn := this.conn(key)
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("INCRBY", key, delta)
+	if expire > 0 {
+		conn.Send("PEXPIRE", key, expire.Milliseconds())
+	}
+	vals, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		this.failed("increase", key, err)
+		return 0, err
+	}
+	if len(vals) == 0 {
+		return 0, errEmptyData
+	}
+
+	return redis.Int64(vals[0], nil)
+}
+
+// 原子计数减少
+func (this *redisConnect) Decrease(key string, delta int64, expire time.Duration) (int64, error) {
+	return this.Increase(key, -delta, expire)
+}
+
+// 计数键
+func (this *redisConnect) counterKey(key string) string {
+	return this.setting.CounterPrefix + this.key(key)
+}
+
+// 追加数据，只支持 raw 编码，base64 编码后的数据无法直接拼接
+// 适合记录活动轨迹之类只增不改的会话字段，省掉读改写的往返
+// 和 Write 一样检查大小限制和租户配额、维护索引、发变更事件
+func (this *redisConnect) Append(key string, data []byte, expire time.Duration) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+	if !this.raw() {
+		return errRawEncodingRequired
+	}
+	if len(data) == 0 {
+		return errEmptyData
+	}
+
+	return this.splice("append", key, -1, data, expire)
+}
+
+// 追加或者覆盖写入一段，ARGV[1] 为 -1 时追加，否则是覆盖写入的偏移
+// ARGV[3] 过期时间毫秒，ARGV[4] 大小上限，ARGV[5] 租户配额，ARGV[6] 当前时间毫秒
+// 返回 {结果, 写入后大小, 剩余毫秒}，结果 1 成功，-1 超限，-2 超出配额，-3 带信封不能拼接
+var spliceScript = redis.NewScript(2, `
+local offset = tonumber(ARGV[1])
+local data = ARGV[2]
+local magic = ARGV[9]
+local size = redis.call('STRLEN', KEYS[1])
+local exists = redis.call('EXISTS', KEYS[1]) == 1
+if exists and size == #ARGV[8] and redis.call('GET', KEYS[1]) == ARGV[8] then
+	redis.call('DEL', KEYS[1])
+	exists = false
+	size = 0
+end
+local head = ''
+if size > 0 then
+	head = redis.call('GETRANGE', KEYS[1], 0, #magic - 1)
+end
+if head == magic then
+	return {-3, size, 0}
+end
+if offset < 0 then
+	head = head .. string.sub(data, 1, #magic)
+elseif offset < #magic then
+	if #head < offset then
+		head = head .. string.rep('\0', offset - #head)
+	end
+	head = string.sub(head, 1, offset) .. data .. string.sub(head, offset + #data + 1)
+end
+if string.sub(head, 1, #magic) == magic then
+	return {-3, size, 0}
+end
+local total = size + #data
+if offset >= 0 then
+	total = math.max(size, offset + #data)
+end
+local limit = tonumber(ARGV[4])
+if limit > 0 and total > limit then
+	return {-1, total, 0}
+end
+local now = tonumber(ARGV[6])
+if KEYS[2] ~= '' then
+	redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', now)
+	local quota = tonumber(ARGV[5])
+	if not exists and quota > 0 and redis.call('ZCARD', KEYS[2]) >= quota then
+		return {-2, size, 0}
+	end
+end
+if offset < 0 then
+	redis.call('APPEND', KEYS[1], data)
+else
+	redis.call('SETRANGE', KEYS[1], offset, data)
+end
+local expire = tonumber(ARGV[3])
+if expire > 0 then
+	redis.call('PEXPIRE', KEYS[1], expire)
+end
+local ttl = redis.call('PTTL', KEYS[1])
+if KEYS[2] ~= '' then
+	if ttl > 0 then
+		redis.call('ZADD', KEYS[2], now + ttl, ARGV[7])
+	else
+		redis.call('ZADD', KEYS[2], '+inf', ARGV[7])
+	end
+end
+return {1, total, ttl}
+`)
+
+// 追加或者覆盖写入，能在服务器上直接拼接的用脚本，一次往返
+// 有校验器要看完整数据、要记历史、维护窗口要排队、超限要压缩，这些情况都退回读改写
+func (this *redisConnect) splice(op string, id string, offset int64, data []byte, expire time.Duration) error {
+	this.flush(id)
+
+	if this.spliceWhole() {
+		return this.update(id, expire, func(old []byte) ([]byte, error) {
+			return spliced(old, offset, data), nil
+		})
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	key := this.key(id)
+	tenant := this.tenant(id)
+	tenantKey := ""
+	if tenant != "" {
+		tenantKey = this.tenantKey(tenant)
+	}
+
+	//allow 策略不拦，写入后只记超限
+	limit := this.setting.MaxSize
+	if this.setting.Oversize == oversizeAllow {
+		limit = 0
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	reply, err := redis.Int64s(spliceScript.Do(
+		conn, key, tenantKey,
+		offset, data, expire.Milliseconds(), limit, this.tenantQuota(tenant), now, id,
+		this.tombstone(), envelopeMagic,
+	))
+	if err != nil {
+		this.failed(op, id, err)
+		return err
+	}
+	if len(reply) < 3 {
+		return errEmptyData
+	}
+
+	switch reply[0] {
+	case -1:
+		this.metric("oversize", 1)
+		this.metric("oversize."+this.setting.Oversize, 1)
+		return &SizeError{ID: id, Size: reply[1], Limit: this.setting.MaxSize}
+	case -2:
+		return &QuotaError{Tenant: tenant, Quota: this.tenantQuota(tenant)}
+	case -3:
+		//带信封的会话不能直接拼接
+		return this.update(id, expire, func(old []byte) ([]byte, error) {
+			return spliced(old, offset, data), nil
+		})
+	}
+
+	if this.setting.MaxSize > 0 && reply[1] > this.setting.MaxSize {
+		this.metric("oversize", 1)
+		this.metric("oversize."+this.setting.Oversize, 1)
+		this.warning("session.redis.oversize", id, reply[1], this.setting.MaxSize)
+	}
+
+	this.uncache(key)
+	written := time.Duration(0)
+	if reply[2] > 0 {
+		written = time.Duration(reply[2]) * time.Millisecond
+	}
+	if this.setting.Index {
+		this.indexWrite(id, written)
+	}
+	this.keyRemember(conn, id)
+	this.metric("session.write", 1)
+	this.emit(EventWrite, id, written)
+
+	return nil
+}
+
+// 不能在服务器上直接拼接的情况
+func (this *redisConnect) spliceWhole() bool {
+	this.mutex.RLock()
+	validators := len(this.validators)
+	this.mutex.RUnlock()
+
+	if validators > 0 || this.setting.History > 0 || this.Maintaining() {
+		return true
+	}
+	return this.setting.MaxSize > 0 && this.setting.Oversize == oversizeCompress
+}
+
+// 按 APPEND、SETRANGE 的语义拼出新的数据，偏移超出时中间补零
+func spliced(old []byte, offset int64, data []byte) []byte {
+	if offset < 0 {
+		out := make([]byte, 0, len(old)+len(data))
+		return append(append(out, old...), data...)
+	}
+	size := int64(len(old))
+	if end := offset + int64(len(data)); end > size {
+		size = end
+	}
+	out := make([]byte, size)
+	copy(out, old)
+	copy(out[offset:], data)
+	return out
+}
+
+// 设置绝对过期时间，会话可以对齐到固定的截止时间，比如下班时间、IdP令牌的过期时间
+func (this *redisConnect) ExpireAt(id string, at time.Time) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	ms := at.UnixNano() / int64(time.Millisecond)
+
+	set, err := redis.Int(conn.Do("PEXPIREAT", this.key(id), ms))
+	if err != nil {
+		this.failed("expireat", id, err)
+		return err
+	}
+	//会话不存在
+	if set == 0 {
+		return this.missing()
+	}
+
+	//租户会话集合按过期时间排序，要同步更新
+	if tenant := this.tenant(id); tenant != "" {
+		if _, err := conn.Do("ZADD", this.tenantKey(tenant), "XX", ms, id); err != nil {
+			this.failed("expireat", id, err)
+			return err
+		}
+	}
+	if this.setting.Index {
+		if _, err := conn.Do("ZADD", this.indexKey(indexExpiry), "XX", ms, id); err != nil {
+			this.failed("expireat", id, err)
+			return err
+		}
+	}
+	this.emit(EventExpire, id, time.Until(at))
+
+	return nil
+}
+
+// 读取会话的一段字节，包含 end，只支持 raw 编码
+// 适合固定布局的大会话只读其中的一小块，比如标记字节
+func (this *redisConnect) ReadRange(id string, start, end int64) ([]byte, error) {
+	if this.client == nil {
+		return nil, errInvalidCacheConnection
+	}
+	if !this.raw() {
+		return nil, errRawEncodingRequired
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GETRANGE", this.key(id), start, end))
+	if err != nil && err != redis.ErrNil {
+		this.failed("readrange", id, err)
+		return nil, err
+	}
+	return data, nil
+}
+
+// 从 offset 开始覆盖写入一段字节，只支持 raw 编码，过期时间不变
+func (this *redisConnect) WriteRange(id string, offset int64, data []byte) error {
+	if this.client == nil {
+		return errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return err
+	}
+	if !this.raw() {
+		return errRawEncodingRequired
+	}
+	if len(data) == 0 {
+		return errEmptyData
+	}
+
+	if offset < 0 {
+		return errInvalidRange
+	}
+
+	return this.splice("writerange", id, offset, data, 0)
+}
+
+// 值相同时才删除，ARGV[1] 为租户集合成员，后面是可能的编码值
+var deleteIfScript = redis.NewScript(2, `
+local value = redis.call('GET', KEYS[1])
+if not value then
+	return 0
+end
+for i = 2, #ARGV do
+	if value == ARGV[i] then
+		redis.call('DEL', KEYS[1])
+		if KEYS[2] ~= '' then
+			redis.call('ZREM', KEYS[2], ARGV[1])
+		end
+		return 1
+	end
+end
+return 0
+`)
+
+// 会话内容和 expected 一致时才删除，返回是否删除
+// 注销时用，避免撤销掉已被并发轮换成新内容的会话
+func (this *redisConnect) DeleteIf(id string, expected []byte) (bool, error) {
+	if this.client == nil {
+		return false, errInvalidCacheConnection
+	}
+	if err := this.writable(); err != nil {
+		return false, err
+	}
+
+	//先落盘还没写到服务器的合并写入，和最新的值比较
+	this.flush(id)
+
+	//加密后同样的内容每次密文都不同，只能解密后比较
+	if this.encrypted() {
+		return this.deleteIfWatch(id, expected)
+	}
+
+	conn := this.conn(this.key(id))
+	defer conn.Close()
+
+	key := this.key(id)
+	tenantKey := ""
+	if tenant := this.tenant(id); tenant != "" {
+		tenantKey = this.tenantKey(tenant)
+	}
+
+	//超限压缩过的会话是另一种编码，一起比较
+	value, err := this.marshal(id, expected, false)
+	if err != nil {
+		return false, err
+	}
+	args := []Any{key, tenantKey, id, value}
+	if this.setting.MaxSize > 0 && this.setting.Oversize == oversizeCompress {
+		if compressed, err := this.marshal(id, expected, true); err == nil {
+			args = append(args, compressed)
+		}
+	}
+
+	deleted, err := redis.Int(deleteIfScript.Do(conn, args...))
+	if err != nil {
+		this.failed("deleteif", id, err)
+		return false, err
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+
+	this.uncache(key)
+	if this.setting.Index {
+		this.indexRemove(id)
+	}
+	this.keyForget(conn, id)
+	this.metric("session.delete", 1)
+	this.emit(EventDelete, id, 0)
+	return true, nil
+}
+
+// 解密后比较的 DeleteIf，用 WATCH 保证比较和删除之间没有被改过
+func (this *redisConnect) deleteIfWatch(id string, expected []byte) (bool, error) {
+	deleted := false
+	err := this.Update(id, func(old []byte) ([]byte, error) {
+		if old == nil || !bytes.Equal(old, expected) {
+			return nil, errNotMatched
+		}
+		deleted = true
+		return nil, nil
+	})
+	if err == errNotMatched {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if deleted {
+		this.metric("session.delete", 1)
+		this.emit(EventDelete, id, 0)
+	}
+	return deleted, nil
+}
+
+// 是否可以按字节直接操作存储的值，raw 编码并且没有加密
+func (this *redisConnect) raw() bool {
+	return this.setting.Encoding == encodingRaw && !this.encrypted()
+}
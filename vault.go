@@ -0,0 +1,182 @@
+package session_redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+)
+
+// Vault 动态凭据，配置里不需要长期有效的 Redis 密码
+// 从 secret 取用户名密码，按租约续期，续不了或者凭据变了就重新取，并重建连接
+var (
+	errInvalidVaultSecret = errors.New("Invalid vault secret.")
+)
+
+type (
+	redisVault struct {
+		Address string
+		Token   string
+		Path    string
+		client  *http.Client
+
+		leaseID   string
+		lease     time.Duration
+		renewable bool
+	}
+
+	vaultSecret struct {
+		LeaseID       string `json:"lease_id"`
+		LeaseDuration int64  `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+		Data          Map    `json:"data"`
+	}
+)
+
+// 解析配置，vault = { address, token, path }，address 和 token 可以用 VAULT_ADDR、VAULT_TOKEN 环境变量
+func parseVault(setting Map) (*redisVault, error) {
+	config, ok := setting["vault"].(Map)
+	if !ok {
+		return nil, nil
+	}
+
+	vault := &redisVault{
+		Address: os.Getenv("VAULT_ADDR"),
+		Token:   os.Getenv("VAULT_TOKEN"),
+		client:  &http.Client{Timeout: time.Second * 10},
+	}
+	if vv, ok := config["address"].(string); ok && vv != "" {
+		vault.Address = vv
+	}
+	if vv, ok := config["token"].(string); ok && vv != "" {
+		vault.Token = vv
+	}
+	if vv, ok := config["path"].(string); ok && vv != "" {
+		vault.Path = strings.Trim(vv, "/")
+	}
+
+	if vault.Address == "" || vault.Path == "" {
+		return nil, errors.New("Invalid session vault setting, address and path required.")
+	}
+
+	vault.Address = strings.TrimRight(vault.Address, "/")
+	return vault, nil
+}
+
+func (vault *redisVault) request(method, path string, body Any) (*vaultSecret, error) {
+	var reader *bytes.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req, err := http.NewRequest(method, vault.Address+"/v1/"+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vault.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := vault.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("Vault %s %s: %s", method, path, res.Status)
+	}
+
+	secret := &vaultSecret{}
+	if err := json.NewDecoder(res.Body).Decode(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// 取凭据，兼容 database 引擎（data.username）和 KV v2（data.data.username）
+func (this *redisConnect) vaultLogin() error {
+	secret, err := this.vault.request("GET", this.vault.Path, nil)
+	if err != nil {
+		return err
+	}
+
+	data := secret.Data
+	if inner, ok := data["data"].(Map); ok {
+		data = inner
+	}
+	username, _ := data["username"].(string)
+	password, _ := data["password"].(string)
+	if password == "" {
+		return errInvalidVaultSecret
+	}
+
+	this.mutex.Lock()
+	changed := this.setting.Username != username || this.setting.Password != password
+	this.setting.Username = username
+	this.setting.Password = password
+	this.mutex.Unlock()
+
+	this.vault.leaseID = secret.LeaseID
+	this.vault.lease = time.Second * time.Duration(secret.LeaseDuration)
+	this.vault.renewable = secret.Renewable
+
+	if changed && this.client != nil {
+		this.rebuild()
+	}
+	return nil
+}
+
+// 续租约
+func (this *redisConnect) vaultRenew() error {
+	secret, err := this.vault.request("PUT", "sys/leases/renew", Map{
+		"lease_id": this.vault.leaseID,
+	})
+	if err != nil {
+		return err
+	}
+	this.vault.lease = time.Second * time.Duration(secret.LeaseDuration)
+	return nil
+}
+
+// 在租约过去三分之二时续期，没有租约的按分钟检查凭据是否变化
+func (this *redisConnect) vaultRenewing() {
+	defer this.waiter.Done()
+
+	for {
+		wait := time.Minute
+		if this.vault.lease > 0 {
+			wait = this.vault.lease * 2 / 3
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-time.After(wait):
+		}
+
+		if this.vault.renewable && this.vault.leaseID != "" {
+			err := this.vaultRenew()
+			if err == nil {
+				continue
+			}
+			this.failed("vault", "", err)
+		}
+		if err := this.vaultLogin(); err != nil {
+			this.failed("vault", "", err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package session_redis
+
+import (
+	"bytes"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 完整性校验，用当前的编码、压缩、加密配置逐个解码前缀下的会话，找出解不开的
+// 编码迁移、换密钥、从备份恢复 Redis 以后跑一遍
+// 只校验信封格式的值，没有信封的旧格式会话、计数之类的值无从判断，跳过，base64 编码时解不开 base64 的算损坏
+// 取不到密钥这类错误说明不了会话损坏，记为未校验，不会被删除
+const (
+	verifyReportLimit = 1000 //最多列出的损坏会话数
+)
+
+type (
+	// CorruptEntry 解不开的会话
+	CorruptEntry struct {
+		ID    string
+		Size  int
+		Error string
+	}
+
+	// VerifyReport 完整性校验的结果，损坏的最多列出 1000 个，超出时 Truncated 为 true
+	VerifyReport struct {
+		Checked    int64 //校验的会话数
+		Skipped    int64 //不是信封格式，跳过的值
+		Unverified int64 //取不到密钥等原因没能校验的会话数
+		Corrupted  int64 //损坏的会话数
+		Removed    int64 //删除的损坏会话数
+		Corrupt    []CorruptEntry
+		Truncated  bool
+	}
+)
+
+// 校验前缀下的全部会话，remove 为 true 时删除解不开的会话
+func (this *redisConnect) Verify(prefix string, remove bool) (VerifyReport, error) {
+	report := VerifyReport{Corrupt: []CorruptEntry{}}
+	if this.client == nil {
+		return report, errInvalidCacheConnection
+	}
+	if remove {
+		if err := this.writable(); err != nil {
+			return report, err
+		}
+	}
+
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			keys = this.within(keys, prefix)
+			for _, group := range this.slots(keys) {
+				for _, batch := range chunks(group, this.setting.ReadBatch) {
+					corrupt, err := this.verifyBatch(conn, batch, &report)
+					if err != nil {
+						return err
+					}
+					for _, entry := range corrupt {
+						report.Corrupted++
+						if len(report.Corrupt) < verifyReportLimit {
+							report.Corrupt = append(report.Corrupt, entry)
+						} else {
+							report.Truncated = true
+						}
+						if !remove {
+							continue
+						}
+						if err := this.drop(entry.ID, false); err != nil {
+							this.failed("verify", entry.ID, err)
+							continue
+						}
+						report.Removed++
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		this.failed("verify", prefix, err)
+		return report, err
+	}
+
+	this.metric("verify.corrupt", report.Corrupted)
+	this.warning("session.redis.verify", prefix, report.Checked, report.Corrupted, report.Removed)
+	return report, nil
+}
+
+// 一批键逐个解码，返回解不开的，墓碑和已经不存在的跳过
+func (this *redisConnect) verifyBatch(conn redis.Conn, keys []string, report *VerifyReport) ([]CorruptEntry, error) {
+	ids, found := []string{}, []string{}
+	for _, key := range keys {
+		if id, ok := this.id(key); ok {
+			ids = append(ids, id)
+			found = append(found, key)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	ids = this.originals(conn, ids)
+	for _, key := range found {
+		conn.Send("GET", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	values := make([]string, len(ids))
+	hashed := []int{}
+	for i := range ids {
+		value, err := redis.String(conn.Receive())
+		if err == redis.ErrNil {
+			values[i] = this.tombstone()
+			continue
+		}
+		//字段存储的会话，逐个字段校验
+		if _, ok := err.(redis.Error); ok {
+			hashed = append(hashed, i)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	corrupt := []CorruptEntry{}
+	for i, id := range ids {
+		value := values[i]
+		if value == this.tombstone() || value == "" {
+			continue
+		}
+		if entry, ok := this.verifyValue(id, value, report); !ok {
+			corrupt = append(corrupt, entry)
+		}
+	}
+
+	for _, i := range hashed {
+		fields, err := redis.Strings(conn.Do("HVALS", this.key(ids[i])))
+		if err != nil {
+			continue
+		}
+		for _, field := range fields {
+			if entry, ok := this.verifyValue(ids[i], field, report); !ok {
+				corrupt = append(corrupt, entry)
+				break
+			}
+		}
+	}
+
+	return corrupt, nil
+}
+
+// 校验一个存储的值，返回 false 表示确实损坏
+func (this *redisConnect) verifyValue(id, value string, report *VerifyReport) (CorruptEntry, bool) {
+	//base64 都解不开的值肯定坏了
+	packed, err := decodeWith(value, this.setting.Encoding)
+	if err != nil {
+		report.Checked++
+		return CorruptEntry{ID: id, Size: len(value), Error: err.Error()}, false
+	}
+	if !bytes.HasPrefix(packed, []byte(envelopeMagic)) {
+		report.Skipped++
+		return CorruptEntry{}, true
+	}
+
+	report.Checked++
+	if _, err := this.unpack(id, packed); err != nil {
+		if !corrupted(err) {
+			report.Unverified++
+			this.failed("verify", id, err)
+			return CorruptEntry{}, true
+		}
+		return CorruptEntry{ID: id, Size: len(value), Error: err.Error()}, false
+	}
+	return CorruptEntry{}, true
+}
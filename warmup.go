@@ -0,0 +1,78 @@
+package session_redis
+
+import (
+	"errors"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 预热，部署之后本地读缓存是空的，高流量站点冷启动会有一阵延迟尖峰，启动时先把热点会话读进缓存
+var (
+	errCacheDisabled = errors.New("Session cache not enabled.")
+)
+
+// 把指定的会话读进本地缓存，返回缓存的个数
+func (this *redisConnect) Warmup(ids []string) (int, error) {
+	if !this.setting.Cache {
+		return 0, errCacheDisabled
+	}
+
+	count := 0
+	for _, batch := range chunks(ids, this.setting.ReadBatch) {
+		results, err := this.readMulti(batch)
+		if err != nil {
+			return count, err
+		}
+		count += len(results)
+	}
+	return count, nil
+}
+
+// 按前缀扫描预热，最多 limit 个，limit 小于等于0时按缓存容量
+func (this *redisConnect) WarmupPrefix(prefix string, limit int) (int, error) {
+	if !this.setting.Cache {
+		return 0, errCacheDisabled
+	}
+	if this.client == nil {
+		return 0, errInvalidCacheConnection
+	}
+	if limit <= 0 || limit > this.setting.CacheSize {
+		limit = this.setting.CacheSize
+	}
+
+	count, scanned := 0, 0
+	err := this.masters(func(conn redis.Conn) error {
+		return this.scan(conn, this.pattern(prefix), func(keys []string) error {
+			//关闭时停止
+			select {
+			case <-this.done:
+				return errStopped
+			default:
+			}
+
+			ids := []string{}
+			for _, key := range this.within(keys, prefix) {
+				if id, ok := this.id(key); ok && scanned < limit {
+					ids = append(ids, id)
+					scanned++
+				}
+			}
+			warmed, err := this.Warmup(ids)
+			count += warmed
+			if err != nil {
+				return err
+			}
+			if scanned >= limit {
+				return errStopped
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopped {
+		this.failed("warmup", prefix, err)
+		return count, err
+	}
+
+	this.metric("warmup", int64(count))
+	return count, nil
+}
@@ -0,0 +1,263 @@
+package session_redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	. "github.com/infrago/base"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// 过期通知，订阅键空间事件，会话过期或被删除时回调 HTTP webhook，用于 SSO 的 back-channel 注销
+// 需要服务器开启 notify-keyspace-events 的 E、g、x，configure 为 true 时 Open 时自动补上
+// 通知是服务器推送的，订阅断开期间的事件会丢失，投递失败按 retries 退避重试
+const (
+	webhookQueue = 1024
+)
+
+var (
+	errWebhookURL = errors.New("Invalid session webhook setting, url required.")
+)
+
+type (
+	redisWebhook struct {
+		URL       string
+		Header    string //认证头，默认 Authorization
+		Auth      string //认证头的值，比如 Bearer xxx
+		Retries   int
+		Timeout   time.Duration
+		Configure bool //自动设置 notify-keyspace-events
+
+		client *http.Client
+		queue  chan webhookEvent
+	}
+
+	webhookEvent struct {
+		Event string    `json:"event"`
+		ID    string    `json:"id"`
+		Time  time.Time `json:"time"`
+	}
+)
+
+// 解析配置，webhook = { url, header, auth, retries, timeout, configure }
+func parseWebhook(setting Map) (*redisWebhook, error) {
+	config, ok := setting["webhook"].(Map)
+	if !ok {
+		return nil, nil
+	}
+
+	webhook := &redisWebhook{Header: "Authorization", Retries: 3, Timeout: time.Second * 5}
+	if vv, ok := config["url"].(string); ok && vv != "" {
+		webhook.URL = vv
+	}
+	if webhook.URL == "" {
+		return nil, errWebhookURL
+	}
+	if vv, ok := config["header"].(string); ok && vv != "" {
+		webhook.Header = vv
+	}
+	if vv, ok := config["auth"].(string); ok && vv != "" {
+		webhook.Auth = vv
+	}
+	if vv, ok := config["retries"].(int64); ok && vv >= 0 {
+		webhook.Retries = int(vv)
+	}
+	if vv, ok := parseDuration(config["timeout"]); ok && vv > 0 {
+		webhook.Timeout = vv
+	}
+	if vv, ok := config["configure"].(bool); ok {
+		webhook.Configure = vv
+	}
+
+	webhook.client = &http.Client{Timeout: webhook.Timeout}
+	return webhook, nil
+}
+
+// 打开订阅和投递
+func (this *redisConnect) openWebhook() error {
+	addrs := []string{this.server()}
+	if this.setting.Cluster {
+		addrs = this.clusterMasters()
+	}
+
+	if this.webhook.Configure {
+		for _, addr := range addrs {
+			if err := this.notifyEvents(addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	this.webhook.queue = make(chan webhookEvent, webhookQueue)
+	this.waiter.Add(1)
+	go this.webhooking()
+
+	//集群模式下每个主节点的事件只在本节点发布
+	for _, addr := range addrs {
+		this.waiter.Add(1)
+		go this.watchExpiry(addr)
+	}
+	return nil
+}
+
+// 补上需要的事件类型，不覆盖已有的配置
+func (this *redisConnect) notifyEvents(addr string) error {
+	conn, err := this.dial(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if len(values) > 1 {
+		flags = values[1]
+	}
+	needs := []string{"E", "g", "x"}
+	if strings.Contains(flags, "A") {
+		//A 已经包含 g 和 x
+		needs = needs[:1]
+	}
+	for _, flag := range needs {
+		if !strings.Contains(flags, flag) {
+			flags += flag
+		}
+	}
+	_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", flags)
+	return err
+}
+
+// 订阅断开后隔一秒重连
+func (this *redisConnect) watchExpiry(addr string) {
+	defer this.waiter.Done()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		default:
+		}
+
+		if err := this.subscribeExpiry(addr); err != nil {
+			this.failed("webhook", addr, err)
+		}
+
+		select {
+		case <-this.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (this *redisConnect) subscribeExpiry(addr string) error {
+	conn, err := this.dial(addr)
+	if err != nil {
+		return err
+	}
+
+	//Close 时关掉订阅连接，让 Receive 返回
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-this.done:
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	prefix := fmt.Sprintf("__keyevent@%d__:", this.setting.Database)
+	psc := redis.PubSubConn{Conn: conn}
+	if err := psc.Subscribe(prefix+"expired", prefix+"del"); err != nil {
+		return err
+	}
+
+	for {
+		switch v := psc.Receive().(type) {
+		case redis.Message:
+			id, ok := this.id(string(v.Data))
+			if !ok {
+				continue
+			}
+			event := "deleted"
+			if strings.HasSuffix(v.Channel, "expired") {
+				event = "expired"
+			}
+			select {
+			case this.webhook.queue <- webhookEvent{Event: event, ID: id, Time: time.Now()}:
+			default:
+				this.metric("webhook.dropped", 1)
+			}
+		case error:
+			return v
+		}
+	}
+}
+
+// 投递
+func (this *redisConnect) webhooking() {
+	defer this.waiter.Done()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case event := <-this.webhook.queue:
+			if err := this.deliver(event); err != nil {
+				this.metric("webhook.failed", 1)
+				this.failed("webhook", event.ID, err)
+			}
+		}
+	}
+}
+
+// POST 一个事件，失败按 100ms、200ms、400ms 退避重试
+func (this *redisConnect) deliver(event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = this.post(body)
+		if err == nil || attempt >= this.webhook.Retries {
+			return err
+		}
+		select {
+		case <-this.done:
+			return err
+		case <-time.After(time.Millisecond * 100 << uint(attempt)):
+		}
+	}
+}
+
+func (this *redisConnect) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, this.webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if this.webhook.Auth != "" {
+		req.Header.Set(this.webhook.Header, this.webhook.Auth)
+	}
+
+	res, err := this.webhook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("Session webhook returned %s.", res.Status)
+	}
+	return nil
+}